@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// argStyle is how a gcloud action takes the version or service.
+type argStyle int
+
+const (
+	argNone       argStyle = iota // the action doesn't take it
+	argPositional                 // gcloud app versions describe VERSION
+	argFlag                       // gcloud app logs read --version VERSION
+)
+
+func (s argStyle) append(args []string, flag, value string) []string {
+	switch s {
+	case argPositional:
+		return append(args, value)
+	case argFlag:
+		return append(args, flag, value)
+	default:
+		return args
+	}
+}
+
+// gcloudAction describes how to run a `gcloud app` action.
+type gcloudAction struct {
+	// command is the gcloud command when it differs from the action name
+	command string
+	// deploy actions are handed a yaml file and report the deploy results
+	deploy bool
+	// version and service are how the action takes the version and service
+	version argStyle
+	service argStyle
+	// region is how the action takes the region
+	region argStyle
+	// flags are always passed to the action
+	flags []string
+	// local actions are run by the plugin instead of gcloud
+	local func(runner *Environ, workspace string, vargs GAE) error
+}
+
+// gcloudActions are the supported `gcloud app` actions. Groups get their
+// command (ex: list) from sub_commands.
+var gcloudActions = map[string]gcloudAction{
+	"deploy":           {deploy: true, version: argFlag, service: argFlag},
+	"services":         {version: argFlag, service: argPositional},
+	"versions":         {version: argPositional, service: argFlag},
+	"instances":        {version: argFlag, service: argFlag},
+	"firewall-rules":   {},
+	"domain-mappings":  {},
+	"ssl-certificates": {},
+	"logs":             {version: argFlag, service: argFlag},
+	"operations":       {},
+	"regions":          {},
+	"create":           {region: argFlag},
+	"describe":         {},
+	// `update` is the appcfg.py name for deploying, so app settings get their own name
+	"update-settings": {command: "update"},
+	// open the app without launching a browser in the build container
+	"browse":       {version: argFlag, service: argFlag, flags: []string{"--no-launch-browser"}},
+	"open-console": {local: openConsole},
+	// reconcile the firewall rules with firewall.yaml
+	"firewall-sync": {local: syncFirewall},
+	// reconcile the domain mappings and their certificates with domains.yaml
+	"domains-sync": {local: syncDomains},
+	// delete the preview version of a pull request or branch
+	"preview-cleanup": {local: cleanupPreview},
+}
+
+// openConsole prints the Cloud Console URL for the app, service or version
+// instead of trying to open a browser like `gcloud app open-console` does.
+func openConsole(runner *Environ, workspace string, vargs GAE) error {
+	fmt.Println(consoleURL(vargs))
+	return nil
+}
+
+func consoleURL(vargs GAE) string {
+	q := url.Values{}
+	q.Set("project", vargs.Project)
+	if vargs.Service != "" {
+		q.Set("serviceId", vargs.Service)
+	}
+	page := "https://console.cloud.google.com/appengine"
+	if vargs.Version != "" {
+		page += "/instances"
+		q.Set("versionId", vargs.Version)
+	}
+	return page + "?" + q.Encode()
+}
+
+// appcfgTranslations rewrite the common appcfg.py actions into the gcloud
+// commands that replace them.
+var appcfgTranslations = map[string]func(vargs *GAE){
+	// appcfg.py update => gcloud app deploy ./app.yaml
+	"update": func(vargs *GAE) {
+		vargs.Action = "deploy"
+	},
+	// appcfg.py update_cron => gcloud app deploy ./cron.yaml
+	"update_cron": func(vargs *GAE) {
+		vargs.Action = "deploy"
+		if vargs.CronFile == "" {
+			vargs.CronFile = "cron.yaml"
+		}
+	},
+	// appcfg.py update_dispatch => gcloud app deploy ./dispatch.yaml
+	"update_dispatch": func(vargs *GAE) {
+		vargs.Action = "deploy"
+		if vargs.DispatchFile == "" {
+			vargs.DispatchFile = "dispatch.yaml"
+		}
+	},
+	// appcfg.py set_default_version => gcloud app versions migrate VERSION --service SERVICE
+	"set_default_version": func(vargs *GAE) {
+		vargs.Action = "versions"
+		vargs.SubCommands = []string{"migrate"}
+	},
+}
+
+// routeAction makes sure the action is one we know how to run. Translatable
+// appcfg.py actions are rewritten to gcloud, anything else that isn't a gcloud
+// action is only passed to appcfg.py in legacy mode.
+func routeAction(vargs *GAE) error {
+	if _, ok := gcloudActions[vargs.Action]; ok {
+		return nil
+	}
+
+	if vargs.LegacyAppCfg {
+		fmt.Printf("warning: running deprecated appcfg.py action %q\n", vargs.Action)
+		return nil
+	}
+
+	if translate, ok := appcfgTranslations[vargs.Action]; ok {
+		action := vargs.Action
+		translate(vargs)
+		fmt.Printf("translated appcfg.py action %q to `gcloud app %s`\n",
+			action, strings.Join(append([]string{vargs.Action}, vargs.SubCommands...), " "))
+		return nil
+	}
+
+	return fmt.Errorf("unknown action %q: must be one of %s, or one of the appcfg.py actions %s. "+
+		"Set legacy_appcfg to run other appcfg.py actions",
+		vargs.Action, strings.Join(gcloudActionNames(), ", "), strings.Join(translatedActions(), ", "))
+}
+
+// gcloudActionNames lists the supported `gcloud app` actions.
+func gcloudActionNames() []string {
+	var actions []string
+	for a := range gcloudActions {
+		actions = append(actions, a)
+	}
+	sort.Strings(actions)
+	return actions
+}
+
+// translatedActions lists the appcfg.py actions that are run with gcloud.
+func translatedActions() []string {
+	var actions []string
+	for a := range appcfgTranslations {
+		actions = append(actions, a)
+	}
+	sort.Strings(actions)
+	return actions
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteAction(t *testing.T) {
+	tests := []struct {
+		name    string
+		vargs   GAE
+		want    GAE
+		wantErr string
+	}{
+		{
+			name:  "gcloud command",
+			vargs: GAE{Action: "deploy"},
+			want:  GAE{Action: "deploy"},
+		},
+		{
+			name:  "gcloud group",
+			vargs: GAE{Action: "versions", SubCommands: []string{"list"}},
+			want:  GAE{Action: "versions", SubCommands: []string{"list"}},
+		},
+		{
+			name:  "update",
+			vargs: GAE{Action: "update"},
+			want:  GAE{Action: "deploy"},
+		},
+		{
+			name:  "update_cron",
+			vargs: GAE{Action: "update_cron"},
+			want:  GAE{Action: "deploy", CronFile: "cron.yaml"},
+		},
+		{
+			name:  "update_cron with custom file",
+			vargs: GAE{Action: "update_cron", CronFile: "cron-prd.yaml"},
+			want:  GAE{Action: "deploy", CronFile: "cron-prd.yaml"},
+		},
+		{
+			name:  "update_dispatch",
+			vargs: GAE{Action: "update_dispatch"},
+			want:  GAE{Action: "deploy", DispatchFile: "dispatch.yaml"},
+		},
+		{
+			name:  "set_default_version",
+			vargs: GAE{Action: "set_default_version", Version: "v1", Service: "api"},
+			want:  GAE{Action: "versions", SubCommands: []string{"migrate"}, Version: "v1", Service: "api"},
+		},
+		{
+			name:  "set_default_version default service",
+			vargs: GAE{Action: "set_default_version", Version: "v1"},
+			want:  GAE{Action: "versions", SubCommands: []string{"migrate"}, Version: "v1"},
+		},
+		{
+			name:  "legacy mode",
+			vargs: GAE{Action: "update_indexes", LegacyAppCfg: true},
+			want:  GAE{Action: "update_indexes", LegacyAppCfg: true},
+		},
+		{
+			name:  "legacy mode doesn't translate",
+			vargs: GAE{Action: "update", LegacyAppCfg: true},
+			want:  GAE{Action: "update", LegacyAppCfg: true},
+		},
+		{
+			name:    "typo",
+			vargs:   GAE{Action: "deplyo"},
+			wantErr: `unknown action "deplyo": must be one of browse, create, deploy, describe, domain-mappings`,
+		},
+		{
+			name:    "untranslated appcfg action",
+			vargs:   GAE{Action: "update_indexes"},
+			wantErr: "Set legacy_appcfg",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := routeAction(&test.vargs)
+			if test.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, test.vargs)
+		})
+	}
+}
+
+func TestGcloudArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		vargs GAE
+		want  []string
+	}{
+		{
+			name:  "deploy",
+			vargs: GAE{Action: "deploy", Project: "prj", Version: "v1", FlexImage: "gcr.io/img"},
+			want: []string{"app", "deploy", "./app.yaml", "--version", "v1", "--image-url", "gcr.io/img",
+				"--project", "prj", "--quiet", "--format", "json"},
+		},
+		{
+			name:  "versions group",
+			vargs: GAE{Action: "versions", SubCommands: []string{"stop"}, Project: "prj", Version: "v1", Service: "api"},
+			want:  []string{"app", "versions", "stop", "v1", "--service", "api", "--project", "prj", "--quiet"},
+		},
+		{
+			name:  "set_default_version",
+			vargs: GAE{Action: "versions", SubCommands: []string{"migrate"}, Project: "prj", Version: "v1", Service: "api"},
+			want:  []string{"app", "versions", "migrate", "v1", "--service", "api", "--project", "prj", "--quiet"},
+		},
+		{
+			name:  "instances group",
+			vargs: GAE{Action: "instances", SubCommands: []string{"list"}, Project: "prj", Version: "v1", Service: "api"},
+			want:  []string{"app", "instances", "list", "--version", "v1", "--service", "api", "--project", "prj", "--quiet"},
+		},
+		{
+			name:  "services group",
+			vargs: GAE{Action: "services", SubCommands: []string{"describe"}, Project: "prj", Version: "v1", Service: "api"},
+			want:  []string{"app", "services", "describe", "--version", "v1", "api", "--project", "prj", "--quiet"},
+		},
+		{
+			name: "firewall-rules ignores version and service",
+			vargs: GAE{Action: "firewall-rules", SubCommands: []string{"create", "100"}, Project: "prj",
+				Version: "v1", Service: "api", FlexImage: "gcr.io/img"},
+			want: []string{"app", "firewall-rules", "create", "100", "--project", "prj", "--quiet"},
+		},
+		{
+			name:  "logs takes flags",
+			vargs: GAE{Action: "logs", SubCommands: []string{"read"}, Project: "prj", Version: "v1", Service: "api"},
+			want:  []string{"app", "logs", "read", "--version", "v1", "--service", "api", "--project", "prj", "--quiet"},
+		},
+		{
+			name:  "update-settings",
+			vargs: GAE{Action: "update-settings", Project: "prj", AddlFlags: []string{"--split-health-checks"}},
+			want:  []string{"app", "update", "--project", "prj", "--quiet", "--split-health-checks"},
+		},
+		{
+			name:  "browse",
+			vargs: GAE{Action: "browse", Project: "prj", Service: "api", Beta: true},
+			want:  []string{"beta", "app", "browse", "--service", "api", "--project", "prj", "--quiet", "--no-launch-browser"},
+		},
+		{
+			name:  "create",
+			vargs: GAE{Action: "create", Project: "prj", AddlArgs: map[string]string{"--region": "us-central"}},
+			want:  []string{"app", "create", "--project", "prj", "--quiet", "--region", "us-central"},
+		},
+		{
+			name:  "create in region",
+			vargs: GAE{Action: "create", Project: "prj", Region: "us-central"},
+			want:  []string{"app", "create", "--region", "us-central", "--project", "prj", "--quiet"},
+		},
+		{
+			name:  "region ignored by other actions",
+			vargs: GAE{Action: "describe", Project: "prj", Region: "us-central"},
+			want:  []string{"app", "describe", "--project", "prj", "--quiet"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.want, gcloudArgs("/ws", test.vargs))
+		})
+	}
+}
+
+func TestConsoleURL(t *testing.T) {
+	assert.Equal(t, "https://console.cloud.google.com/appengine?project=prj",
+		consoleURL(GAE{Project: "prj"}))
+	assert.Equal(t, "https://console.cloud.google.com/appengine/instances?project=prj&serviceId=api&versionId=v1",
+		consoleURL(GAE{Project: "prj", Service: "api", Version: "v1"}))
+}
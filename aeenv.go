@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// mergeAEEnv merges AEEnv into the env_variables of the rendered app.yaml,
+// which is how `gcloud app deploy` sets environment variables.
+func mergeAEEnv(workspace string, vargs GAE) error {
+	appLoc := appFilePath(workspace, vargs)
+	blob, err := ioutil.ReadFile(appLoc)
+	if err != nil {
+		return fmt.Errorf("error reading app.yaml for ae_environment: %s\n", err)
+	}
+
+	merged, err := mergeEnvVariables(blob, vargs.AEEnv, vargs.AEEnvConflict)
+	if err != nil {
+		return fmt.Errorf("error merging ae_environment into app.yaml: %s\n", err)
+	}
+
+	err = ioutil.WriteFile(appLoc, merged, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing app.yaml: %s\n", err)
+	}
+	return nil
+}
+
+// mergeEnvVariables adds env to the env_variables section of an app.yaml,
+// keeping the order of the existing keys. policy decides what happens when a
+// variable is already set in app.yaml: "override" (the default) uses the
+// value from env, "keep" uses the value from app.yaml and "error" fails.
+func mergeEnvVariables(blob []byte, env map[string]string, policy string) ([]byte, error) {
+	switch policy {
+	case "", "override", "keep", "error":
+	default:
+		return nil, fmt.Errorf("invalid param ae_environment_conflict %q: must be override, keep or error", policy)
+	}
+
+	var app yaml.MapSlice
+	if err := yaml.Unmarshal(blob, &app); err != nil {
+		return nil, err
+	}
+
+	idx := -1
+	for i, item := range app {
+		if item.Key == "env_variables" {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		app = append(app, yaml.MapItem{Key: "env_variables", Value: yaml.MapSlice{}})
+		idx = len(app) - 1
+	}
+
+	vars, ok := app[idx].Value.(yaml.MapSlice)
+	if !ok && app[idx].Value != nil {
+		return nil, fmt.Errorf("env_variables must be a mapping")
+	}
+
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		found := false
+		for i, item := range vars {
+			if fmt.Sprint(item.Key) != k {
+				continue
+			}
+			found = true
+			switch policy {
+			case "keep":
+			case "error":
+				return nil, fmt.Errorf("env_variables.%s is set in both app.yaml and ae_environment", k)
+			default:
+				vars[i].Value = env[k]
+			}
+		}
+		if !found {
+			vars = append(vars, yaml.MapItem{Key: k, Value: env[k]})
+		}
+	}
+	app[idx].Value = vars
+
+	return yaml.Marshal(app)
+}
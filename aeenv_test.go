@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeEnvVariables(t *testing.T) {
+	tests := []struct {
+		name    string
+		app     string
+		env     map[string]string
+		policy  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "adds section",
+			app:  "runtime: go\n",
+			env:  map[string]string{"B": "2", "A": "1"},
+			want: "runtime: go\nenv_variables:\n  A: \"1\"\n  B: \"2\"\n",
+		},
+		{
+			name: "merges into existing section",
+			app:  "env_variables:\n  Z: z\nruntime: go\n",
+			env:  map[string]string{"A": "a"},
+			want: "env_variables:\n  Z: z\n  A: a\nruntime: go\n",
+		},
+		{
+			name: "override by default",
+			app:  "runtime: go\nenv_variables:\n  A: old\n",
+			env:  map[string]string{"A": "new"},
+			want: "runtime: go\nenv_variables:\n  A: new\n",
+		},
+		{
+			name:   "keep app.yaml value",
+			app:    "runtime: go\nenv_variables:\n  A: old\n",
+			env:    map[string]string{"A": "new"},
+			policy: "keep",
+			want:   "runtime: go\nenv_variables:\n  A: old\n",
+		},
+		{
+			name:    "error on conflict",
+			app:     "runtime: go\nenv_variables:\n  A: old\n",
+			env:     map[string]string{"A": "new"},
+			policy:  "error",
+			wantErr: true,
+		},
+		{
+			name:   "error without conflict",
+			app:    "runtime: go\nenv_variables:\n  A: old\n",
+			env:    map[string]string{"B": "new"},
+			policy: "error",
+			want:   "runtime: go\nenv_variables:\n  A: old\n  B: new\n",
+		},
+		{
+			name: "empty section",
+			app:  "runtime: go\nenv_variables:\n",
+			env:  map[string]string{"A": "a"},
+			want: "runtime: go\nenv_variables:\n  A: a\n",
+		},
+		{
+			name:    "section not a mapping",
+			app:     "runtime: go\nenv_variables: [a]\n",
+			env:     map[string]string{"A": "a"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown policy",
+			app:     "runtime: go\n",
+			env:     map[string]string{"A": "a"},
+			policy:  "merge",
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := mergeEnvVariables([]byte(test.app), test.env, test.policy)
+			if test.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, string(got))
+		})
+	}
+}
+
+func TestMergeAEEnv(t *testing.T) {
+	workspace, err := ioutil.TempDir("", "drone-gae-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(workspace)
+	stage, err := ioutil.TempDir("", "drone-gae-stage")
+	require.NoError(t, err)
+	defer os.RemoveAll(stage)
+
+	orig := "runtime: go\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(workspace, "app.yaml"), []byte(orig), 0644))
+
+	vargs := GAE{
+		Action:   "deploy",
+		AppFile:  "app.yaml",
+		AEEnv:    map[string]string{"TOKEN": "secret"},
+		stageDir: stage,
+	}
+	require.NoError(t, setupFiles(workspace, vargs))
+	require.NoError(t, mergeAEEnv(workspace, vargs))
+
+	staged, err := ioutil.ReadFile(appFilePath(workspace, vargs))
+	require.NoError(t, err)
+	assert.Equal(t, "runtime: go\nenv_variables:\n  TOKEN: secret\n", string(staged))
+
+	// the workspace copy is never modified
+	blob, err := ioutil.ReadFile(filepath.Join(workspace, "app.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, orig, string(blob))
+}
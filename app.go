@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// errNoApp is how gcloud reports a project without an App Engine application.
+const errNoApp = "does not contain an App Engine application"
+
+// ensureApp creates the App Engine application in vargs.Region if the
+// project doesn't have one yet.
+func ensureApp(runner *Environ, vargs GAE) error {
+	_, stderr, err := runner.Capture(vargs.GCloudCmd, "app", "describe",
+		"--project", vargs.Project, "--format", "json", "--quiet")
+	if err == nil {
+		return nil
+	}
+	if !strings.Contains(string(stderr), errNoApp) {
+		return fmt.Errorf("error: unable to describe App Engine application: %s\n", err)
+	}
+
+	log.Printf("creating App Engine application for project %q in region %q", vargs.Project, vargs.Region)
+
+	err = runner.Run(vargs.GCloudCmd, "app", "create",
+		"--region", vargs.Region, "--project", vargs.Project, "--quiet")
+	if err != nil {
+		return fmt.Errorf("error: %s\n", err)
+	}
+	return nil
+}
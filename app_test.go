@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnsureApp(t *testing.T) {
+	tests := []struct {
+		name        string
+		describeErr string
+		wantCalls   []string
+		wantErr     bool
+	}{
+		{
+			name:      "app exists",
+			wantCalls: []string{"app describe --project prj --format json --quiet"},
+		},
+		{
+			name:        "app missing",
+			describeErr: "ERROR: (gcloud.app.describe) The current Google Cloud project [prj] does not contain an App Engine application.",
+			wantCalls: []string{
+				"app describe --project prj --format json --quiet",
+				"app create --region us-central --project prj --quiet",
+			},
+		},
+		{
+			name:        "other error",
+			describeErr: "ERROR: (gcloud.app.describe) PERMISSION_DENIED",
+			wantCalls:   []string{"app describe --project prj --format json --quiet"},
+			wantErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "drone-gae-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			vargs := GAE{
+				GCloudCmd: writeFakeGcloud(t, dir, `if [ "$2" = "describe" ] && [ -n "`+test.describeErr+`" ]; then
+	echo "`+test.describeErr+`" >&2
+	exit 1
+fi`),
+				Project: "prj",
+				Region:  "us-central",
+			}
+			runner := NewEnviron(dir, nil, &bytes.Buffer{}, &bytes.Buffer{})
+
+			err = ensureApp(runner, vargs)
+			if test.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			assert.Equal(t, test.wantCalls, gcloudCalls(t, dir))
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	certManaged = "managed" // a certificate App Engine provisions and renews
+	certNone    = "none"    // no certificate, http only
+)
+
+// DomainMapping is a custom domain and the SSL certificate serving it.
+type DomainMapping struct {
+	Domain string `yaml:"domain"`
+	// Certificate is "managed" (default), "none" or the id or display name of an
+	// uploaded certificate (see `gcloud app ssl-certificates list`).
+	Certificate string `yaml:"certificate"`
+}
+
+// domainsFile is the format of domains.yaml.
+type domainsFile struct {
+	Domains []DomainMapping `yaml:"domains"`
+}
+
+// domainMappingInfo is a single entry of `gcloud app domain-mappings list --format json`.
+type domainMappingInfo struct {
+	ID          string `json:"id"`
+	SSLSettings struct {
+		CertificateID     string `json:"certificateId"`
+		SSLManagementType string `json:"sslManagementType"`
+	} `json:"sslSettings"`
+}
+
+// certificate returns the mapping's certificate the way domains.yaml names it.
+func (d domainMappingInfo) certificate() string {
+	switch {
+	case d.SSLSettings.SSLManagementType == "AUTOMATIC":
+		return certManaged
+	case d.SSLSettings.CertificateID != "":
+		return d.SSLSettings.CertificateID
+	default:
+		return certNone
+	}
+}
+
+// sslCertificateInfo is a single entry of `gcloud app ssl-certificates list --format json`.
+type sslCertificateInfo struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"displayName"`
+}
+
+// domainChange is a single step needed to reconcile the domain mappings.
+type domainChange struct {
+	op     string // create, update or delete
+	domain string
+	from   string // certificate before
+	to     string // certificate after
+}
+
+func (c domainChange) String() string {
+	switch c.op {
+	case "create":
+		return fmt.Sprintf("create %s (certificate %s)", c.domain, c.to)
+	case "update":
+		return fmt.Sprintf("update %s (certificate %s -> %s)", c.domain, c.from, c.to)
+	default:
+		return fmt.Sprintf("delete %s", c.domain)
+	}
+}
+
+// syncDomains reconciles the project's domain mappings and their SSL
+// certificates with the rendered domains.yaml. With DryRun set the changes
+// are only printed.
+func syncDomains(runner *Environ, workspace string, vargs GAE) error {
+	loc := renderedFile(workspace, vargs, "domains.yaml", vargs.DomainsFile)
+	blob, err := ioutil.ReadFile(loc)
+	if err != nil {
+		return fmt.Errorf("error reading domains file: %s\n", err)
+	}
+	desired, err := parseDomainMappings(blob)
+	if err != nil {
+		return fmt.Errorf("error: invalid domains file %s: %s\n", vargs.DomainsFile, err)
+	}
+
+	// uploaded certificates may be referred to by name, gcloud wants the id
+	if needsCertificateIDs(desired) {
+		certJSON, err := runner.Output(vargs.GCloudCmd, "app", "ssl-certificates", "list",
+			"--project", vargs.Project, "--format", "json", "--quiet")
+		if err != nil {
+			return fmt.Errorf("error: %s\n", err)
+		}
+		var certs []sslCertificateInfo
+		err = json.Unmarshal(certJSON, &certs)
+		if err != nil {
+			return fmt.Errorf("error parsing ssl certificates: %s\n", err)
+		}
+		err = resolveCertificateIDs(desired, certs)
+		if err != nil {
+			return fmt.Errorf("error: %s\n", err)
+		}
+	}
+
+	mappingJSON, err := runner.Output(vargs.GCloudCmd, "app", "domain-mappings", "list",
+		"--project", vargs.Project, "--format", "json", "--quiet")
+	if err != nil {
+		return fmt.Errorf("error: %s\n", err)
+	}
+	var current []domainMappingInfo
+	err = json.Unmarshal(mappingJSON, &current)
+	if err != nil {
+		return fmt.Errorf("error parsing domain mappings: %s\n", err)
+	}
+
+	changes := diffDomainMappings(current, desired)
+	if len(changes) == 0 {
+		fmt.Println("domain mappings are up to date")
+		return nil
+	}
+
+	for _, c := range changes {
+		fmt.Printf("domains: %s\n", c)
+	}
+	if vargs.DryRun {
+		fmt.Printf("dry run: not applying %d domain mapping changes\n", len(changes))
+		return nil
+	}
+
+	for _, c := range changes {
+		err = runner.Run(vargs.GCloudCmd, domainArgs(vargs, c)...)
+		if err != nil {
+			return fmt.Errorf("error: %s\n", err)
+		}
+	}
+	return nil
+}
+
+// parseDomainMappings reads and validates the mappings in a domains.yaml.
+func parseDomainMappings(blob []byte) ([]DomainMapping, error) {
+	var f domainsFile
+	if err := yaml.UnmarshalStrict(blob, &f); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for i, d := range f.Domains {
+		if d.Domain == "" {
+			return nil, fmt.Errorf("domains[%d]: missing domain", i)
+		}
+		if seen[d.Domain] {
+			return nil, fmt.Errorf("domains[%d]: duplicate domain %s", i, d.Domain)
+		}
+		seen[d.Domain] = true
+		if d.Certificate == "" {
+			f.Domains[i].Certificate = certManaged
+		}
+	}
+	return f.Domains, nil
+}
+
+func needsCertificateIDs(desired []DomainMapping) bool {
+	for _, d := range desired {
+		if d.Certificate != certManaged && d.Certificate != certNone {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveCertificateIDs swaps certificate display names for their ids.
+func resolveCertificateIDs(desired []DomainMapping, certs []sslCertificateInfo) error {
+	ids := map[string]string{}
+	for _, c := range certs {
+		ids[c.ID] = c.ID
+	}
+	for _, c := range certs {
+		if c.DisplayName == "" {
+			continue
+		}
+		if id, ok := ids[c.DisplayName]; ok && id != c.ID {
+			return fmt.Errorf("ssl certificate name %q is ambiguous", c.DisplayName)
+		}
+		ids[c.DisplayName] = c.ID
+	}
+
+	for i, d := range desired {
+		if d.Certificate == certManaged || d.Certificate == certNone {
+			continue
+		}
+		id, ok := ids[d.Certificate]
+		if !ok {
+			return fmt.Errorf("unknown ssl certificate %q for %s", d.Certificate, d.Domain)
+		}
+		desired[i].Certificate = id
+	}
+	return nil
+}
+
+// diffDomainMappings returns the changes that turn current into desired,
+// ordered by domain.
+func diffDomainMappings(current []domainMappingInfo, desired []DomainMapping) []domainChange {
+	have := map[string]string{}
+	for _, d := range current {
+		have[d.ID] = d.certificate()
+	}
+	want := map[string]bool{}
+
+	var changes []domainChange
+	for _, d := range desired {
+		want[d.Domain] = true
+		cert, ok := have[d.Domain]
+		switch {
+		case !ok:
+			changes = append(changes, domainChange{op: "create", domain: d.Domain, to: d.Certificate})
+		case cert != d.Certificate:
+			changes = append(changes, domainChange{op: "update", domain: d.Domain, from: cert, to: d.Certificate})
+		}
+	}
+	for _, d := range current {
+		if !want[d.ID] {
+			changes = append(changes, domainChange{op: "delete", domain: d.ID, from: d.certificate()})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].domain < changes[j].domain
+	})
+	return changes
+}
+
+// domainArgs builds the gcloud arguments to apply a change.
+func domainArgs(vargs GAE, c domainChange) []string {
+	args := []string{"app", "domain-mappings", c.op, c.domain}
+	switch {
+	case c.op == "delete":
+	case c.to == certManaged:
+		args = append(args, "--certificate-management", "automatic")
+	case c.to == certNone:
+		args = append(args, "--certificate-management", "manual")
+		if c.op == "update" {
+			args = append(args, "--no-certificate-id")
+		}
+	default:
+		args = append(args, "--certificate-management", "manual", "--certificate-id", c.to)
+	}
+	return append(args, "--project", vargs.Project, "--quiet")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDomainMappings(t *testing.T) {
+	got, err := parseDomainMappings([]byte(`
+domains:
+  - domain: example.com
+  - domain: www.example.com
+    certificate: none
+  - domain: api.example.com
+    certificate: my-cert
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []DomainMapping{
+		{Domain: "example.com", Certificate: "managed"},
+		{Domain: "www.example.com", Certificate: "none"},
+		{Domain: "api.example.com", Certificate: "my-cert"},
+	}, got)
+
+	_, err = parseDomainMappings([]byte("domains:\n  - certificate: none\n"))
+	assert.EqualError(t, err, "domains[0]: missing domain")
+
+	_, err = parseDomainMappings([]byte("domains:\n  - domain: a.com\n  - domain: a.com\n"))
+	assert.EqualError(t, err, "domains[1]: duplicate domain a.com")
+
+	_, err = parseDomainMappings([]byte("domains:\n  - domain: a.com\n    cert: none\n"))
+	assert.Error(t, err)
+}
+
+func TestResolveCertificateIDs(t *testing.T) {
+	certs := []sslCertificateInfo{
+		{ID: "123", DisplayName: "my-cert"},
+		{ID: "456"},
+	}
+	desired := []DomainMapping{
+		{Domain: "a.com", Certificate: "my-cert"},
+		{Domain: "b.com", Certificate: "456"},
+		{Domain: "c.com", Certificate: "managed"},
+	}
+	require.NoError(t, resolveCertificateIDs(desired, certs))
+	assert.Equal(t, "123", desired[0].Certificate)
+	assert.Equal(t, "456", desired[1].Certificate)
+	assert.Equal(t, "managed", desired[2].Certificate)
+
+	err := resolveCertificateIDs([]DomainMapping{{Domain: "a.com", Certificate: "other"}}, certs)
+	assert.EqualError(t, err, `unknown ssl certificate "other" for a.com`)
+}
+
+func TestDiffDomainMappings(t *testing.T) {
+	var current []domainMappingInfo
+	err := json.Unmarshal([]byte(`[
+		{"id": "a.com", "sslSettings": {"certificateId": "999", "sslManagementType": "AUTOMATIC"}},
+		{"id": "b.com", "sslSettings": {"certificateId": "123", "sslManagementType": "MANUAL"}},
+		{"id": "c.com"},
+		{"id": "old.com", "sslSettings": {"sslManagementType": "AUTOMATIC"}}
+	]`), &current)
+	require.NoError(t, err)
+
+	desired := []DomainMapping{
+		{Domain: "new.com", Certificate: "managed"},
+		{Domain: "a.com", Certificate: "managed"},
+		{Domain: "b.com", Certificate: "managed"},
+		{Domain: "c.com", Certificate: "123"},
+	}
+
+	assert.Equal(t, []domainChange{
+		{op: "update", domain: "b.com", from: "123", to: "managed"},
+		{op: "update", domain: "c.com", from: "none", to: "123"},
+		{op: "create", domain: "new.com", to: "managed"},
+		{op: "delete", domain: "old.com", from: "managed"},
+	}, diffDomainMappings(current, desired))
+}
+
+func TestDomainArgs(t *testing.T) {
+	vargs := GAE{Project: "prj"}
+	tests := []struct {
+		change domainChange
+		want   []string
+	}{
+		{
+			domainChange{op: "create", domain: "a.com", to: "managed"},
+			[]string{"app", "domain-mappings", "create", "a.com", "--certificate-management", "automatic", "--project", "prj", "--quiet"},
+		},
+		{
+			domainChange{op: "update", domain: "a.com", from: "managed", to: "none"},
+			[]string{"app", "domain-mappings", "update", "a.com", "--certificate-management", "manual", "--no-certificate-id", "--project", "prj", "--quiet"},
+		},
+		{
+			domainChange{op: "update", domain: "a.com", from: "none", to: "123"},
+			[]string{"app", "domain-mappings", "update", "a.com", "--certificate-management", "manual", "--certificate-id", "123", "--project", "prj", "--quiet"},
+		},
+		{
+			domainChange{op: "delete", domain: "a.com", from: "managed"},
+			[]string{"app", "domain-mappings", "delete", "a.com", "--project", "prj", "--quiet"},
+		},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, domainArgs(vargs, test.change), test.change.String())
+	}
+}
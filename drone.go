@@ -0,0 +1,63 @@
+package main
+
+// DroneMeta is the Drone build metadata available to templates as .Drone
+type DroneMeta struct {
+	// SHA is the full commit SHA and ShortSHA its first 8 characters.
+	SHA      string
+	ShortSHA string
+	// Branch is the branch of the commit. For pull requests this is the target
+	// branch, SourceBranch is the branch being merged.
+	Branch       string
+	SourceBranch string
+	Tag          string
+	BuildNumber  string
+	Event        string
+	// BuildAction is the action behind the event, ex: "close" for a pull request
+	// that was closed.
+	BuildAction string
+	PullRequest string
+	Repo        string
+	Author      string
+	DeployTo    string
+}
+
+// droneMetadata reads the build metadata Drone passes to every plugin.
+func droneMetadata(getenv func(string) string) DroneMeta {
+	meta := DroneMeta{
+		SHA:          getenv("DRONE_COMMIT_SHA"),
+		Branch:       getenv("DRONE_COMMIT_BRANCH"),
+		SourceBranch: getenv("DRONE_SOURCE_BRANCH"),
+		Tag:          getenv("DRONE_TAG"),
+		BuildNumber:  getenv("DRONE_BUILD_NUMBER"),
+		Event:        getenv("DRONE_BUILD_EVENT"),
+		BuildAction:  getenv("DRONE_BUILD_ACTION"),
+		PullRequest:  getenv("DRONE_PULL_REQUEST"),
+		Repo:         getenv("DRONE_REPO"),
+		Author:       getenv("DRONE_COMMIT_AUTHOR"),
+		DeployTo:     getenv("DRONE_DEPLOY_TO"),
+	}
+	// older versions of drone only set these
+	if meta.SHA == "" {
+		meta.SHA = getenv("DRONE_COMMIT")
+	}
+	if meta.Branch == "" {
+		meta.Branch = getenv("DRONE_BRANCH")
+	}
+	if meta.SourceBranch == "" {
+		meta.SourceBranch = meta.Branch
+	}
+
+	meta.ShortSHA = meta.SHA
+	if len(meta.ShortSHA) > 8 {
+		meta.ShortSHA = meta.ShortSHA[:8]
+	}
+	return meta
+}
+
+// PluginMeta is the resolved plugin configuration available to templates
+// as .Plugin
+type PluginMeta struct {
+	Project string
+	Service string
+	Version string
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDroneMetadata(t *testing.T) {
+	env := map[string]string{
+		"DRONE_COMMIT_SHA":    "0123456789abcdef",
+		"DRONE_COMMIT_BRANCH": "main",
+		"DRONE_SOURCE_BRANCH": "feature/thing",
+		"DRONE_BUILD_NUMBER":  "42",
+		"DRONE_BUILD_EVENT":   "pull_request",
+		"DRONE_BUILD_ACTION":  "synchronized",
+		"DRONE_PULL_REQUEST":  "7",
+		"DRONE_REPO":          "nytimes/drone-gae",
+		"DRONE_COMMIT_AUTHOR": "octocat",
+		"DRONE_DEPLOY_TO":     "production",
+	}
+	got := droneMetadata(func(k string) string { return env[k] })
+	assert.Equal(t, DroneMeta{
+		SHA:          "0123456789abcdef",
+		ShortSHA:     "01234567",
+		Branch:       "main",
+		SourceBranch: "feature/thing",
+		BuildNumber:  "42",
+		Event:        "pull_request",
+		BuildAction:  "synchronized",
+		PullRequest:  "7",
+		Repo:         "nytimes/drone-gae",
+		Author:       "octocat",
+		DeployTo:     "production",
+	}, got)
+
+	// fall back to the older variables
+	env = map[string]string{
+		"DRONE_COMMIT": "abc",
+		"DRONE_BRANCH": "develop",
+	}
+	got = droneMetadata(func(k string) string { return env[k] })
+	assert.Equal(t, "abc", got.SHA)
+	assert.Equal(t, "abc", got.ShortSHA)
+	assert.Equal(t, "develop", got.Branch)
+	assert.Equal(t, "develop", got.SourceBranch)
+}
+
+func TestTemplateVarsBuiltins(t *testing.T) {
+	vargs := GAE{
+		Project:      "my-project",
+		Version:      "v1",
+		TemplateVars: map[string]interface{}{"HOST": "example.com"},
+	}
+	vars, err := templateVars(vargs, "app.yaml")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "example.com", vars["HOST"])
+		assert.Equal(t, PluginMeta{Project: "my-project", Version: "v1"}, vars["Plugin"])
+		assert.IsType(t, DroneMeta{}, vars["Drone"])
+	}
+
+	// user supplied vars win
+	vargs.TemplateVars["Plugin"] = "mine"
+	vars, err = templateVars(vargs, "app.yaml")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "mine", vars["Plugin"])
+	}
+}
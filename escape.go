@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// templateVars returns the variables used to render the template name,
+// along with the built-in .Drone and .Plugin variables. Variables are escaped
+// according to TemplateEscape, which only applies to yaml files.
+func templateVars(vargs GAE, name string) (map[string]interface{}, error) {
+	vars := make(map[string]interface{}, len(vargs.TemplateVars)+2)
+
+	builtins := map[string]interface{}{
+		"Drone": droneMetadata(os.Getenv),
+		"Plugin": PluginMeta{
+			Project: vargs.Project,
+			Service: vargs.Service,
+			Version: vargs.Version,
+		},
+	}
+	for k, v := range builtins {
+		if _, ok := vargs.TemplateVars[k]; ok {
+			fmt.Printf("warning: template variable %q hides the built-in .%s variables\n", k, k)
+			continue
+		}
+		vars[k] = v
+	}
+
+	switch vargs.TemplateEscape {
+	case "", "none":
+		for k, v := range vargs.TemplateVars {
+			vars[k] = v
+		}
+	case "yaml":
+		for k, v := range vargs.TemplateVars {
+			if isYAMLFile(name) {
+				v = escapeYAML(v)
+			}
+			vars[k] = v
+		}
+	default:
+		return nil, fmt.Errorf("invalid param template_escape %q: must be \"none\" or \"yaml\"\n", vargs.TemplateEscape)
+	}
+
+	return vars, nil
+}
+
+// isYAMLFile reports whether name is a yaml file, going by its extension.
+func isYAMLFile(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// escapeYAML turns every string in v, including those nested in lists and
+// maps, into a double quoted YAML string.
+func escapeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return strconv.Quote(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, vv := range v {
+			out[i] = escapeYAML(vv)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			out[k] = escapeYAML(vv)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+var reYAMLErrLine = regexp.MustCompile(`line (\d+)`)
+
+// reYAMLSpecial matches values that change meaning when inserted unquoted
+// into YAML: comments, nested mappings, newlines and leading indicators.
+var reYAMLSpecial = regexp.MustCompile(`\s#|:\s|:$|\n|^[-?:,\[\]{}#&*!|>'"%@` + "`" + `]`)
+
+// checkRenderedYAML makes sure a rendered yaml file still parses. Errors
+// point at the offending line, with any secret values masked. The yaml
+// parser only reports the line, so no column is given.
+// It also warns about variables that were inserted without quotes even
+// though they contain characters YAML would interpret.
+func checkRenderedYAML(name string, rendered []byte, vargs GAE) error {
+	if !isYAMLFile(name) {
+		return nil
+	}
+
+	secrets := newRedactor(secretValues(vargs)...)
+
+	var parsed interface{}
+	if err := yaml.Unmarshal(rendered, &parsed); err != nil {
+		msg := secrets.redact(strings.TrimPrefix(err.Error(), "yaml: "))
+		if m := reYAMLErrLine.FindStringSubmatch(err.Error()); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			lines := strings.Split(string(rendered), "\n")
+			if n > 0 && n <= len(lines) {
+				msg += fmt.Sprintf("\n  %d | %s", n, secrets.redact(lines[n-1]))
+			}
+		}
+		return fmt.Errorf("error: rendered %s is not valid YAML: %s\n", name, msg)
+	}
+
+	if vargs.TemplateEscape == "yaml" {
+		return nil
+	}
+
+	var names []string
+	for k := range vargs.TemplateVars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		s, ok := vargs.TemplateVars[k].(string)
+		if !ok || !reYAMLSpecial.MatchString(s) {
+			continue
+		}
+		if containsUnquoted(string(rendered), s) {
+			fmt.Printf("warning: template variable %q contains YAML special characters and "+
+				"appears unquoted in %s: use `quote` or `template_escape: yaml`\n", k, name)
+		}
+	}
+
+	return nil
+}
+
+// containsUnquoted reports whether value appears in s without an opening
+// quote right in front of it.
+func containsUnquoted(s, value string) bool {
+	for i := strings.Index(s, value); i >= 0; {
+		if i == 0 || (s[i-1] != '"' && s[i-1] != '\'') {
+			return true
+		}
+		next := strings.Index(s[i+1:], value)
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateVarsEscape(t *testing.T) {
+	vargs := GAE{
+		TemplateVars: map[string]interface{}{
+			"Secret": "abc#123: x",
+			"Count":  3,
+			"List":   []interface{}{"a\nb"},
+		},
+	}
+
+	vars, err := templateVars(vargs, "app.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc#123: x", vars["Secret"])
+
+	vargs.TemplateEscape = "yaml"
+	vars, err = templateVars(vargs, "app.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, `"abc#123: x"`, vars["Secret"])
+	assert.Equal(t, 3, vars["Count"])
+	assert.Equal(t, []interface{}{`"a\nb"`}, vars["List"])
+	// the original vars are untouched
+	assert.Equal(t, "abc#123: x", vargs.TemplateVars["Secret"])
+
+	// other files get the values as they are
+	vars, err = templateVars(vargs, ".gcloudignore")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc#123: x", vars["Secret"])
+	vars, err = templateVars(vargs, "config.json")
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"a\nb"}, vars["List"])
+
+	vargs.TemplateEscape = "html"
+	_, err = templateVars(vargs, "app.yaml")
+	assert.Error(t, err)
+}
+
+func TestCheckRenderedYAML(t *testing.T) {
+	vargs := GAE{TemplateVars: map[string]interface{}{"Secret": "s3cr3t: value"}}
+
+	err := checkRenderedYAML("app.yaml", []byte("env_variables:\n  KEY: s3cr3t: value\n"), vargs)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "rendered app.yaml is not valid YAML: line 2")
+		assert.Contains(t, err.Error(), "2 |   KEY: [redacted]")
+		assert.NotContains(t, err.Error(), "s3cr3t")
+	}
+
+	assert.NoError(t, checkRenderedYAML("app.yaml", []byte("env_variables:\n  KEY: \"s3cr3t: value\"\n"), vargs))
+
+	// only yaml files are checked
+	assert.NoError(t, checkRenderedYAML("config.json", []byte("KEY: s3cr3t: value"), vargs))
+}
+
+func TestContainsUnquoted(t *testing.T) {
+	assert.True(t, containsUnquoted("KEY: abc #123", "abc #123"))
+	assert.False(t, containsUnquoted(`KEY: "abc #123"`, "abc #123"))
+	assert.True(t, containsUnquoted(`A: "abc #123"`+"\nB: abc #123", "abc #123"))
+	assert.False(t, containsUnquoted("KEY: value", "abc #123"))
+}
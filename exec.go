@@ -1,11 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os/exec"
 	"regexp"
 	"strings"
+	"time"
 )
 
 var reRedact = regexp.MustCompile(`(?:^|\s+)(-E\s+\S+:|--oauth2_access_token\s+)({[\s\S]*}|\S+)`)
@@ -15,6 +17,12 @@ type Environ struct {
 	env    []string
 	stdout io.Writer
 	stderr io.Writer
+
+	// secrets are masked in the command lines and output we print
+	secrets *redactor
+
+	// commands records every command run, for the result file
+	commands []CommandTiming
 }
 
 func NewEnviron(dir string, env []string, stdout, stderr io.Writer) *Environ {
@@ -28,12 +36,63 @@ func NewEnviron(dir string, env []string, stdout, stderr io.Writer) *Environ {
 
 // Run executes the given program.
 func (e *Environ) Run(name string, arg ...string) error {
+	return e.run(nil, nil, name, arg...)
+}
+
+// Output executes the given program and returns what it wrote to stdout
+// instead of passing it along to the Environ's stdout.
+func (e *Environ) Output(name string, arg ...string) ([]byte, error) {
+	var out bytes.Buffer
+	err := e.run(&out, nil, name, arg...)
+	return out.Bytes(), err
+}
+
+// Capture executes the given program like Run, but also returns copies of
+// what it wrote to stdout and stderr.
+func (e *Environ) Capture(name string, arg ...string) ([]byte, []byte, error) {
+	var out, errOut bytes.Buffer
+	sout := e.secrets.writer(e.stdout)
+	serr := e.secrets.writer(e.stderr)
+	err := e.run(io.MultiWriter(sout, &out), io.MultiWriter(serr, &errOut), name, arg...)
+	sout.Flush()
+	serr.Flush()
+	return out.Bytes(), errOut.Bytes(), err
+}
+
+// run executes the given program, writing its output to stdout and stderr
+// if given, or to the Environ's (redacted) stdout and stderr otherwise.
+func (e *Environ) run(stdout, stderr io.Writer, name string, arg ...string) error {
 	displayArg := reRedact.ReplaceAllString(strings.Trim(fmt.Sprint(arg), "[]"), " $1 [redacted] ")
+	displayArg = e.secrets.redact(displayArg)
 	fmt.Printf("Running Command: %s %s\n", name, displayArg)
 	cmd := exec.Command(name, arg...)
 	cmd.Dir = e.dir
 	cmd.Env = e.env
-	cmd.Stdout = e.stdout
-	cmd.Stderr = e.stderr
-	return cmd.Run()
+
+	if stdout == nil {
+		w := e.secrets.writer(e.stdout)
+		defer w.Flush()
+		stdout = w
+	}
+	if stderr == nil {
+		w := e.secrets.writer(e.stderr)
+		defer w.Flush()
+		stderr = w
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	start := time.Now()
+	err := cmd.Run()
+
+	timing := CommandTiming{
+		Command: strings.TrimSpace(name + " " + displayArg),
+		Seconds: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		timing.Error = err.Error()
+	}
+	e.commands = append(e.commands, timing)
+
+	return err
 }
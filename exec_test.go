@@ -3,12 +3,35 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// writeFakeGcloud writes a gcloud stand in to dir that records its arguments
+// and then runs script, which can look at them as $1, $2...
+func writeFakeGcloud(t *testing.T, dir, script string) string {
+	body := "#!/bin/sh\necho \"$@\" >> " + filepath.Join(dir, "calls") + "\n" + script + "\n"
+	cmd := filepath.Join(dir, "gcloud")
+	require.NoError(t, ioutil.WriteFile(cmd, []byte(body), 0755))
+	return cmd
+}
+
+// gcloudCalls returns the argument lists the fake gcloud in dir was called with.
+func gcloudCalls(t *testing.T, dir string) []string {
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "calls"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(blob)), "\n")
+}
+
 func TestEnvironRun(t *testing.T) {
 	stdout := &bytes.Buffer{}
 	stderr := &bytes.Buffer{}
@@ -33,3 +56,28 @@ func TestRedaction(t *testing.T) {
 
 	assert.Equal(t, " --oauth2_access_token  [redacted] -E CREDENTIALS: [redacted]", redacted)
 }
+
+func TestEnvironRunRedacted(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	e := &Environ{
+		dir:     "/tmp",
+		env:     []string{"A=1"},
+		stdout:  stdout,
+		stderr:  stderr,
+		secrets: newRedactor("s3cr3t"),
+	}
+
+	err := e.Run("/bin/echo", "token", "s3cr3t")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "token [redacted]\n", stdout.String())
+		assert.Equal(t, "/bin/echo token [redacted]", e.commands[0].Command)
+	}
+
+	// captured output is left intact for parsing
+	out, err := e.Output("/bin/echo", "s3cr3t")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "s3cr3t\n", string(out))
+	}
+}
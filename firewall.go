@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultRulePriority is the priority of the rule App Engine applies when no
+// other rule matches. It can be updated but never created or deleted.
+const defaultRulePriority = 2147483647
+
+// FirewallRule is a single App Engine firewall rule.
+type FirewallRule struct {
+	Priority    int    `yaml:"priority" json:"priority"`
+	Action      string `yaml:"action" json:"action"`
+	SourceRange string `yaml:"source_range" json:"sourceRange"`
+	Description string `yaml:"description" json:"description"`
+}
+
+func (r FirewallRule) String() string {
+	s := fmt.Sprintf("%d %s %s", r.Priority, strings.ToUpper(r.Action), r.SourceRange)
+	if r.Description != "" {
+		s += fmt.Sprintf(" (%s)", r.Description)
+	}
+	return s
+}
+
+// firewallFile is the format of firewall.yaml.
+type firewallFile struct {
+	Rules []FirewallRule `yaml:"rules"`
+}
+
+// firewallChange is a single step needed to reconcile the firewall rules.
+type firewallChange struct {
+	op   string // create, update or delete
+	rule FirewallRule
+}
+
+// syncFirewall reconciles the project's firewall rules with the rendered
+// firewall.yaml. With DryRun set the changes are only printed.
+func syncFirewall(runner *Environ, workspace string, vargs GAE) error {
+	loc := renderedFile(workspace, vargs, "firewall.yaml", vargs.FirewallFile)
+	blob, err := ioutil.ReadFile(loc)
+	if err != nil {
+		return fmt.Errorf("error reading firewall file: %s\n", err)
+	}
+	desired, err := parseFirewallRules(blob)
+	if err != nil {
+		return fmt.Errorf("error: invalid firewall file %s: %s\n", vargs.FirewallFile, err)
+	}
+
+	rulesJSON, err := runner.Output(vargs.GCloudCmd, "app", "firewall-rules", "list",
+		"--project", vargs.Project, "--format", "json", "--quiet")
+	if err != nil {
+		return fmt.Errorf("error: %s\n", err)
+	}
+	var current []FirewallRule
+	err = json.Unmarshal(rulesJSON, &current)
+	if err != nil {
+		return fmt.Errorf("error parsing firewall rules: %s\n", err)
+	}
+
+	changes := diffFirewallRules(current, desired)
+	if len(changes) == 0 {
+		fmt.Println("firewall rules are up to date")
+		return nil
+	}
+
+	for _, c := range changes {
+		fmt.Printf("firewall: %s %s\n", c.op, c.rule)
+	}
+	if vargs.DryRun {
+		fmt.Printf("dry run: not applying %d firewall changes\n", len(changes))
+		return nil
+	}
+
+	for _, c := range changes {
+		err = runner.Run(vargs.GCloudCmd, firewallArgs(vargs, c)...)
+		if err != nil {
+			return fmt.Errorf("error: %s\n", err)
+		}
+	}
+	return nil
+}
+
+// parseFirewallRules reads and validates the rules in a firewall.yaml.
+func parseFirewallRules(blob []byte) ([]FirewallRule, error) {
+	var f firewallFile
+	if err := yaml.UnmarshalStrict(blob, &f); err != nil {
+		return nil, err
+	}
+
+	seen := map[int]bool{}
+	for i, r := range f.Rules {
+		if r.Priority < 1 || r.Priority > defaultRulePriority {
+			return nil, fmt.Errorf("rules[%d]: priority must be between 1 and %d", i, defaultRulePriority)
+		}
+		if seen[r.Priority] {
+			return nil, fmt.Errorf("rules[%d]: duplicate priority %d", i, r.Priority)
+		}
+		seen[r.Priority] = true
+
+		switch strings.ToLower(r.Action) {
+		case "allow", "deny":
+		default:
+			return nil, fmt.Errorf("rules[%d]: action must be allow or deny", i)
+		}
+		if r.SourceRange == "" {
+			return nil, fmt.Errorf("rules[%d]: missing source_range", i)
+		}
+		if r.Priority == defaultRulePriority && r.SourceRange != "*" {
+			return nil, fmt.Errorf("rules[%d]: the default rule must have source_range \"*\"", i)
+		}
+	}
+	return f.Rules, nil
+}
+
+// diffFirewallRules returns the changes that turn current into desired,
+// ordered by priority. The default rule is only ever updated.
+func diffFirewallRules(current, desired []FirewallRule) []firewallChange {
+	have := map[int]FirewallRule{}
+	for _, r := range current {
+		have[r.Priority] = r
+	}
+	want := map[int]bool{}
+
+	var changes []firewallChange
+	for _, r := range desired {
+		want[r.Priority] = true
+		old, ok := have[r.Priority]
+		switch {
+		case !ok:
+			changes = append(changes, firewallChange{op: "create", rule: r})
+		case !strings.EqualFold(old.Action, r.Action) || old.SourceRange != r.SourceRange ||
+			old.Description != r.Description:
+			changes = append(changes, firewallChange{op: "update", rule: r})
+		}
+	}
+	for _, r := range current {
+		if !want[r.Priority] && r.Priority != defaultRulePriority {
+			changes = append(changes, firewallChange{op: "delete", rule: r})
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].rule.Priority < changes[j].rule.Priority
+	})
+	return changes
+}
+
+// firewallArgs builds the gcloud arguments to apply a change.
+func firewallArgs(vargs GAE, c firewallChange) []string {
+	args := []string{"app", "firewall-rules", c.op, strconv.Itoa(c.rule.Priority)}
+	if c.op != "delete" {
+		args = append(args, "--action", strings.ToUpper(c.rule.Action),
+			"--source-range", c.rule.SourceRange, "--description", c.rule.Description)
+	}
+	return append(args, "--project", vargs.Project, "--quiet")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFirewallRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		blob    string
+		want    []FirewallRule
+		wantErr string
+	}{
+		{
+			name: "valid",
+			blob: `
+rules:
+  - priority: 100
+    action: allow
+    source_range: 10.0.0.0/8
+    description: office
+  - priority: 2147483647
+    action: deny
+    source_range: "*"
+`,
+			want: []FirewallRule{
+				{Priority: 100, Action: "allow", SourceRange: "10.0.0.0/8", Description: "office"},
+				{Priority: 2147483647, Action: "deny", SourceRange: "*"},
+			},
+		},
+		{
+			name:    "unknown key",
+			blob:    "rules:\n  - priority: 1\n    action: allow\n    source: '*'\n",
+			wantErr: "field source not found",
+		},
+		{
+			name:    "bad priority",
+			blob:    "rules:\n  - priority: 0\n    action: allow\n    source_range: '*'\n",
+			wantErr: "rules[0]: priority must be between",
+		},
+		{
+			name:    "duplicate priority",
+			blob:    "rules:\n  - {priority: 5, action: allow, source_range: '*'}\n  - {priority: 5, action: deny, source_range: '*'}\n",
+			wantErr: "rules[1]: duplicate priority 5",
+		},
+		{
+			name:    "bad action",
+			blob:    "rules:\n  - {priority: 5, action: block, source_range: '*'}\n",
+			wantErr: "rules[0]: action must be allow or deny",
+		},
+		{
+			name:    "missing source range",
+			blob:    "rules:\n  - {priority: 5, action: allow}\n",
+			wantErr: "rules[0]: missing source_range",
+		},
+		{
+			name:    "default rule source range",
+			blob:    "rules:\n  - {priority: 2147483647, action: allow, source_range: 10.0.0.0/8}\n",
+			wantErr: "the default rule must have source_range",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseFirewallRules([]byte(test.blob))
+			if test.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestDiffFirewallRules(t *testing.T) {
+	current := []FirewallRule{
+		{Priority: 100, Action: "ALLOW", SourceRange: "10.0.0.0/8", Description: "office"},
+		{Priority: 200, Action: "ALLOW", SourceRange: "192.168.0.0/16"},
+		{Priority: 300, Action: "DENY", SourceRange: "1.2.3.4"},
+		{Priority: defaultRulePriority, Action: "ALLOW", SourceRange: "*", Description: "The default action."},
+	}
+	desired := []FirewallRule{
+		{Priority: 400, Action: "allow", SourceRange: "172.16.0.0/12"},
+		{Priority: 100, Action: "allow", SourceRange: "10.0.0.0/8", Description: "office"},
+		{Priority: 200, Action: "deny", SourceRange: "192.168.0.0/16"},
+		{Priority: 50, Action: "allow", SourceRange: "8.8.8.8"},
+	}
+
+	got := diffFirewallRules(current, desired)
+	assert.Equal(t, []firewallChange{
+		{op: "create", rule: desired[3]},
+		{op: "update", rule: desired[2]},
+		{op: "delete", rule: current[2]},
+		{op: "create", rule: desired[0]},
+	}, got)
+
+	// the default rule is updated, never deleted
+	got = diffFirewallRules(current[3:], []FirewallRule{
+		{Priority: defaultRulePriority, Action: "deny", SourceRange: "*", Description: "The default action."},
+	})
+	assert.Equal(t, []firewallChange{{op: "update", rule: FirewallRule{
+		Priority: defaultRulePriority, Action: "deny", SourceRange: "*", Description: "The default action."}}}, got)
+
+	assert.Empty(t, diffFirewallRules(current[3:], nil))
+}
+
+func TestFirewallArgs(t *testing.T) {
+	vargs := GAE{Project: "prj"}
+	rule := FirewallRule{Priority: 100, Action: "allow", SourceRange: "10.0.0.0/8", Description: "office"}
+
+	assert.Equal(t, []string{"app", "firewall-rules", "create", "100", "--action", "ALLOW",
+		"--source-range", "10.0.0.0/8", "--description", "office", "--project", "prj", "--quiet"},
+		firewallArgs(vargs, firewallChange{op: "create", rule: rule}))
+	assert.Equal(t, []string{"app", "firewall-rules", "delete", "100", "--project", "prj", "--quiet"},
+		firewallArgs(vargs, firewallChange{op: "delete", rule: rule}))
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultStorageEndpoint = "https://storage.googleapis.com"
+
+// errLockReplaced is returned when a lock object changed under us.
+var errLockReplaced = fmt.Errorf("lock object was replaced")
+
+// lockPollInterval is how long to wait between attempts to take a held lock.
+var lockPollInterval = 5 * time.Second
+
+// lockInfo describes a held lock.
+type lockInfo struct {
+	owner string
+	since time.Time
+	// generation identifies this copy of a GCS lock object
+	generation string
+}
+
+// lockBackend stores deploy locks.
+type lockBackend interface {
+	// tryLock takes the lock for key. If someone else holds it, it returns
+	// false and who that is.
+	tryLock(key, owner string) (bool, lockInfo, error)
+	// breakLock removes a stale lock, as long as it is still the one described
+	// by held.
+	breakLock(key string, held lockInfo) error
+	// unlock releases a lock taken with tryLock.
+	unlock(key string) error
+}
+
+// validateLock fills in defaults and checks the lock settings.
+func validateLock(vargs *GAE) error {
+	if vargs.Lock == "" {
+		return nil
+	}
+
+	if vargs.LockTimeout == "" {
+		vargs.LockTimeout = "10m"
+	}
+	if _, err := time.ParseDuration(vargs.LockTimeout); err != nil {
+		return fmt.Errorf("invalid param lock_timeout: %s", err)
+	}
+
+	if vargs.LockStaleAfter == "" {
+		vargs.LockStaleAfter = "1h"
+	}
+	if _, err := time.ParseDuration(vargs.LockStaleAfter); err != nil {
+		return fmt.Errorf("invalid param lock_stale_after: %s", err)
+	}
+
+	if strings.HasPrefix(vargs.Lock, "gs://") {
+		bucket, _ := splitGCSPath(vargs.Lock)
+		if bucket == "" {
+			return fmt.Errorf("invalid param lock: missing bucket in %q", vargs.Lock)
+		}
+	}
+	return nil
+}
+
+// acquireDeployLock waits for and takes the deploy lock of the project and
+// service being deployed. The returned func releases it.
+func acquireDeployLock(runner *Environ, workspace string, vargs GAE) (func(), error) {
+	key, err := lockKey(workspace, vargs)
+	if err != nil {
+		return nil, fmt.Errorf("error: unable to determine service to lock: %s\n", err)
+	}
+
+	backend, err := newLockBackend(runner, vargs)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout, _ := time.ParseDuration(vargs.LockTimeout)
+	staleAfter, _ := time.ParseDuration(vargs.LockStaleAfter)
+	err = acquireLock(backend, key, lockOwner(droneMetadata(os.Getenv)), timeout, staleAfter)
+	if err != nil {
+		return nil, fmt.Errorf("error: %s\n", err)
+	}
+	log.Printf("acquired deploy lock %s", key)
+
+	return func() {
+		if err := backend.unlock(key); err != nil {
+			fmt.Printf("warning: unable to release deploy lock %s: %s\n", key, err)
+			return
+		}
+		log.Printf("released deploy lock %s", key)
+	}, nil
+}
+
+// acquireLock polls until it takes the lock or timeout passes. Locks held for
+// longer than staleAfter are assumed to be left over from a crashed build and
+// are broken.
+func acquireLock(backend lockBackend, key, owner string, timeout, staleAfter time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, held, err := backend.tryLock(key, owner)
+		if err != nil {
+			return fmt.Errorf("unable to take deploy lock %s: %s", key, err)
+		}
+		if ok {
+			return nil
+		}
+
+		if staleAfter > 0 && time.Since(held.since) > staleAfter {
+			log.Printf("breaking stale deploy lock %s held by %s since %s", key, held.owner, held.since.Format(time.RFC3339))
+			if err := backend.breakLock(key, held); err != nil {
+				return fmt.Errorf("unable to break stale deploy lock %s: %s", key, err)
+			}
+			continue
+		}
+
+		if !time.Now().Before(deadline) {
+			return fmt.Errorf("timed out after %s waiting for deploy lock %s held by %s since %s",
+				timeout, key, held.owner, held.since.Format(time.RFC3339))
+		}
+		log.Printf("waiting for deploy lock %s held by %s since %s", key, held.owner, held.since.Format(time.RFC3339))
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// lockKey is the project and service being deployed. dispatch.yaml and
+// cron.yaml apply to the whole app, so they get a lock of their own.
+func lockKey(workspace string, vargs GAE) (string, error) {
+	switch {
+	case vargs.DispatchFile != "":
+		return vargs.Project + "/dispatch", nil
+	case vargs.CronFile != "":
+		return vargs.Project + "/cron", nil
+	}
+	service, err := resolveService(workspace, vargs)
+	if err != nil {
+		return "", err
+	}
+	return vargs.Project + "/" + service, nil
+}
+
+// lockOwner describes this build in the lock, so others know who they're
+// waiting for.
+func lockOwner(meta DroneMeta) string {
+	if meta.Repo != "" && meta.BuildNumber != "" {
+		return meta.Repo + "#" + meta.BuildNumber
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s (pid %d)", host, os.Getpid())
+}
+
+func newLockBackend(runner *Environ, vargs GAE) (lockBackend, error) {
+	if !strings.HasPrefix(vargs.Lock, "gs://") {
+		return &fileLock{dir: strings.TrimPrefix(vargs.Lock, "file://")}, nil
+	}
+
+	token, err := accessToken(runner, vargs)
+	if err != nil {
+		return nil, err
+	}
+	bucket, prefix := splitGCSPath(vargs.Lock)
+	return newGCSLock(defaultStorageEndpoint, bucket, prefix, token), nil
+}
+
+// splitGCSPath splits gs://bucket/some/prefix into its bucket and prefix.
+func splitGCSPath(p string) (string, string) {
+	p = strings.TrimPrefix(p, "gs://")
+	parts := strings.SplitN(p, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], strings.Trim(parts[1], "/")
+}
+
+// fileLock keeps locks as files in a directory, which only helps builds that
+// share a file system, like tests.
+type fileLock struct {
+	dir string
+}
+
+func (l *fileLock) path(key string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(key)+".lock")
+}
+
+func (l *fileLock) tryLock(key, owner string) (bool, lockInfo, error) {
+	p := l.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return false, lockInfo{}, err
+	}
+
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err == nil {
+		_, err = f.WriteString(owner)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err == nil, lockInfo{}, err
+	}
+	if !os.IsExist(err) {
+		return false, lockInfo{}, err
+	}
+
+	held, err := readFileLock(p)
+	if os.IsNotExist(err) {
+		// released in the meantime, try again after the poll interval
+		return false, lockInfo{owner: "nobody", since: time.Now()}, nil
+	}
+	return false, held, err
+}
+
+// readFileLock reads who holds the lock file p and since when.
+func readFileLock(p string) (lockInfo, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return lockInfo{}, err
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return lockInfo{}, err
+	}
+	return lockInfo{owner: string(b), since: fi.ModTime()}, nil
+}
+
+func (l *fileLock) breakLock(key string, held lockInfo) error {
+	p := l.path(key)
+
+	// move the lock out of the way first, so only one waiter gets to break it
+	tmp := fmt.Sprintf("%s.%d.%d.stale", p, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(p, tmp); err != nil {
+		if os.IsNotExist(err) {
+			// someone else broke it first, fine
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(tmp)
+
+	got, err := readFileLock(tmp)
+	if err != nil {
+		return err
+	}
+	if got.owner != held.owner || !got.since.Equal(held.since) {
+		// the lock was taken again since we looked at it, put it back
+		if err := os.Link(tmp, p); err != nil {
+			return fmt.Errorf("lock was taken again while breaking it: %s", err)
+		}
+	}
+	return nil
+}
+
+func (l *fileLock) unlock(key string) error {
+	return os.Remove(l.path(key))
+}
+
+// gcsLock keeps locks as objects in a Cloud Storage bucket. Objects are only
+// created if they don't exist yet and only deleted if they haven't been
+// replaced, using generation preconditions.
+type gcsLock struct {
+	endpoint string
+	bucket   string
+	prefix   string
+	token    string
+	client   *http.Client
+
+	// generations of the locks we hold
+	mu          sync.Mutex
+	generations map[string]string
+}
+
+func newGCSLock(endpoint, bucket, prefix, token string) *gcsLock {
+	return &gcsLock{
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		bucket:      bucket,
+		prefix:      prefix,
+		token:       token,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		generations: map[string]string{},
+	}
+}
+
+// gcsObject is the part of the Cloud Storage object metadata we use.
+type gcsObject struct {
+	Generation  string    `json:"generation"`
+	TimeCreated time.Time `json:"timeCreated"`
+}
+
+func (l *gcsLock) object(key string) string {
+	if l.prefix == "" {
+		return key + ".lock"
+	}
+	return l.prefix + "/" + key + ".lock"
+}
+
+func (l *gcsLock) objectURL(key string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", l.endpoint, url.PathEscape(l.bucket), url.PathEscape(l.object(key)))
+}
+
+func (l *gcsLock) do(method, u string, body string) (*http.Response, []byte, error) {
+	req, err := http.NewRequest(method, u, strings.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+l.token)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp, b, err
+}
+
+func (l *gcsLock) tryLock(key, owner string) (bool, lockInfo, error) {
+	// the object holds the owner and is only created if it doesn't exist
+	q := url.Values{}
+	q.Set("uploadType", "media")
+	q.Set("name", l.object(key))
+	q.Set("ifGenerationMatch", "0")
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", l.endpoint, url.PathEscape(l.bucket), q.Encode())
+
+	resp, body, err := l.do(http.MethodPost, u, owner)
+	if err != nil {
+		return false, lockInfo{}, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var obj gcsObject
+		if err := json.Unmarshal(body, &obj); err != nil {
+			return false, lockInfo{}, fmt.Errorf("error parsing lock object: %s", err)
+		}
+		l.mu.Lock()
+		l.generations[key] = obj.Generation
+		l.mu.Unlock()
+		return true, lockInfo{}, nil
+	case http.StatusPreconditionFailed:
+		// someone else has the lock
+	default:
+		return false, lockInfo{}, fmt.Errorf("unexpected status %d creating lock object: %s", resp.StatusCode, body)
+	}
+
+	held, err := l.holder(key)
+	return false, held, err
+}
+
+// holder looks up who holds a lock.
+func (l *gcsLock) holder(key string) (lockInfo, error) {
+	resp, body, err := l.do(http.MethodGet, l.objectURL(key), "")
+	if err != nil {
+		return lockInfo{}, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// released in the meantime, try again after the poll interval
+		return lockInfo{owner: "nobody", since: time.Now()}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return lockInfo{}, fmt.Errorf("unexpected status %d reading lock object: %s", resp.StatusCode, body)
+	}
+	var obj gcsObject
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return lockInfo{}, fmt.Errorf("error parsing lock object: %s", err)
+	}
+	held := lockInfo{since: obj.TimeCreated, generation: obj.Generation}
+
+	resp, body, err = l.do(http.MethodGet, l.objectURL(key)+"?alt=media&ifGenerationMatch="+obj.Generation, "")
+	if err == nil && resp.StatusCode == http.StatusOK {
+		held.owner = string(body)
+	}
+	return held, nil
+}
+
+func (l *gcsLock) delete(key, generation string) error {
+	u := l.objectURL(key)
+	if generation != "" {
+		u += "?ifGenerationMatch=" + url.QueryEscape(generation)
+	}
+	resp, body, err := l.do(http.MethodDelete, u, "")
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	case http.StatusPreconditionFailed:
+		return errLockReplaced
+	default:
+		return fmt.Errorf("unexpected status %d deleting lock object: %s", resp.StatusCode, body)
+	}
+}
+
+func (l *gcsLock) breakLock(key string, held lockInfo) error {
+	err := l.delete(key, held.generation)
+	if err == errLockReplaced {
+		// someone else broke it first, fine
+		return nil
+	}
+	return err
+}
+
+func (l *gcsLock) unlock(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	gen, ok := l.generations[key]
+	if !ok {
+		return fmt.Errorf("lock %s is not held", key)
+	}
+	err := l.delete(key, gen)
+	if err == nil {
+		delete(l.generations, key)
+	}
+	return err
+}
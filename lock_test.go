@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateLock(t *testing.T) {
+	vargs := GAE{Lock: "gs://bucket/locks"}
+	require.NoError(t, validateLock(&vargs))
+	assert.Equal(t, "10m", vargs.LockTimeout)
+	assert.Equal(t, "1h", vargs.LockStaleAfter)
+
+	assert.Error(t, validateLock(&GAE{Lock: "gs://"}))
+	assert.Error(t, validateLock(&GAE{Lock: "/tmp/locks", LockTimeout: "forever"}))
+	assert.Error(t, validateLock(&GAE{Lock: "/tmp/locks", LockStaleAfter: "old"}))
+}
+
+func TestSplitGCSPath(t *testing.T) {
+	bucket, prefix := splitGCSPath("gs://bucket/some/prefix/")
+	assert.Equal(t, "bucket", bucket)
+	assert.Equal(t, "some/prefix", prefix)
+
+	bucket, prefix = splitGCSPath("gs://bucket")
+	assert.Equal(t, "bucket", bucket)
+	assert.Equal(t, "", prefix)
+}
+
+func TestLockKey(t *testing.T) {
+	key, err := lockKey("/ws", GAE{Project: "prj", Service: "api"})
+	require.NoError(t, err)
+	assert.Equal(t, "prj/api", key)
+
+	key, err = lockKey("/ws", GAE{Project: "prj", DispatchFile: "dispatch.yaml"})
+	require.NoError(t, err)
+	assert.Equal(t, "prj/dispatch", key)
+}
+
+// testLockBackend runs the same checks against any backend.
+func testLockBackend(t *testing.T, backend lockBackend) {
+	defer func(d time.Duration) { lockPollInterval = d }(lockPollInterval)
+	lockPollInterval = 5 * time.Millisecond
+
+	require.NoError(t, acquireLock(backend, "prj/api", "build#1", time.Second, time.Hour))
+
+	// held by someone else
+	err := acquireLock(backend, "prj/api", "build#2", 20*time.Millisecond, time.Hour)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out after 20ms waiting for deploy lock prj/api held by build#1")
+
+	// other services aren't affected
+	require.NoError(t, acquireLock(backend, "prj/web", "build#2", time.Second, time.Hour))
+	require.NoError(t, backend.unlock("prj/web"))
+
+	// released while waiting
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		backend.unlock("prj/api")
+	}()
+	require.NoError(t, acquireLock(backend, "prj/api", "build#2", time.Second, time.Hour))
+
+	// a stale lock is broken
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, acquireLock(backend, "prj/api", "build#3", 0, time.Nanosecond))
+	require.NoError(t, backend.unlock("prj/api"))
+}
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-gae-lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testLockBackend(t, &fileLock{dir: dir})
+}
+
+func TestFileLockBreakRetaken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-gae-lock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	l := &fileLock{dir: dir}
+	ok, _, err := l.tryLock("prj/api", "build#1")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// a waiter sees the lock held by build#1...
+	ok, held, err := l.tryLock("prj/api", "build#2")
+	require.NoError(t, err)
+	require.False(t, ok)
+	assert.Equal(t, "build#1", held.owner)
+
+	// ...which is released and taken by build#3 before the waiter breaks it
+	require.NoError(t, l.unlock("prj/api"))
+	ok, _, err = l.tryLock("prj/api", "build#3")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, l.breakLock("prj/api", held))
+
+	// build#3 still holds the lock
+	ok, held, err = l.tryLock("prj/api", "build#4")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, "build#3", held.owner)
+
+	// and breaking the lock that is actually held works
+	require.NoError(t, l.breakLock("prj/api", held))
+	ok, _, err = l.tryLock("prj/api", "build#4")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// nothing is left behind
+	files, err := ioutil.ReadDir(filepath.Join(dir, "prj"))
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+// fakeGCS is just enough of the Cloud Storage JSON API for gcsLock, honoring
+// generation preconditions.
+type fakeGCS struct {
+	mu      sync.Mutex
+	gen     int
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	gen     int
+	created time.Time
+	body    string
+}
+
+func (f *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	q := r.URL.Query()
+	var name string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/upload/storage/v1/b/bucket/o"):
+		name = q.Get("name")
+	case strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+		name = strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	obj, exists := f.objects[name]
+	if want := q.Get("ifGenerationMatch"); want != "" {
+		have := "0"
+		if exists {
+			have = fmt.Sprint(obj.gen)
+		}
+		if want != have {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodPost:
+		body, _ := ioutil.ReadAll(r.Body)
+		f.gen++
+		f.objects[name] = fakeObject{gen: f.gen, created: time.Now(), body: string(body)}
+		fmt.Fprintf(w, `{"generation": "%d"}`, f.gen)
+	case !exists:
+		w.WriteHeader(http.StatusNotFound)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	case q.Get("alt") == "media":
+		fmt.Fprint(w, obj.body)
+	default:
+		fmt.Fprintf(w, `{"generation": "%d", "timeCreated": "%s"}`, obj.gen, obj.created.Format(time.RFC3339Nano))
+	}
+}
+
+func TestGCSLock(t *testing.T) {
+	gcs := &fakeGCS{objects: map[string]fakeObject{}}
+	srv := httptest.NewServer(gcs)
+	defer srv.Close()
+
+	l := newGCSLock(srv.URL, "bucket", "locks", "token")
+	testLockBackend(t, l)
+
+	// the lock objects live under the prefix
+	require.NoError(t, acquireLock(l, "prj/api", "build#4", time.Second, time.Hour))
+	_, ok := gcs.objects["locks/prj/api.lock"]
+	assert.True(t, ok)
+
+	// a lock that was broken and taken by someone else isn't released by us
+	gcs.mu.Lock()
+	gcs.gen++
+	gcs.objects["locks/prj/api.lock"] = fakeObject{gen: gcs.gen, created: time.Now(), body: "build#5"}
+	gcs.mu.Unlock()
+	assert.Error(t, l.unlock("prj/api"))
+	_, ok = gcs.objects["locks/prj/api.lock"]
+	assert.True(t, ok)
+}
@@ -8,9 +8,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 	"text/template"
@@ -26,28 +24,47 @@ var (
 )
 
 type GAE struct {
-	// Action is required and can be any action accepted by the `appcfg.py` or
-	// `gcloud app` commands:
+	// Action is required and must be one of the gcloudActions (deploy, services,
+	// versions, etc.), which run `gcloud app` or are handled by the plugin. Unknown
+	// actions are rejected.
 	//
-	// appcfg.py (update, update_cron, update_indexes, set_default_version, etc.)
-	// gcloud app (deploy, services, versions, etc.)
-	// The appcfg.py commands are deprecated and will no longer work come Oct 2019.
+	// The common appcfg.py actions (update, update_cron, update_dispatch and
+	// set_default_version) are translated to their gcloud equivalents. With
+	// LegacyAppCfg, any action gcloud doesn't know about, translatable or not, is
+	// passed to appcfg.py instead. The appcfg.py commands are deprecated and will
+	// no longer work come Oct 2019.
 	Action string `json:"action"`
 	// AddlArgs is a set of key-value pairs to allow users to pass along any
-	// additional parameters to the `appcfg.py` command.
+	// additional parameters to the `gcloud app` command, or to `appcfg.py` with
+	// LegacyAppCfg.
 	AddlArgs map[string]string `json:"addl_args"`
+	// SecretArgs lists keys of AddlArgs whose values are secret. They are masked in
+	// the logs like TemplateVars and AEEnv values.
+	SecretArgs []string `json:"secret_args"`
 	// AddlFlags is an array of flag parameters that do not have a value.
 	AddlFlags []string `json:"addl_flags"`
 	// Version is used to set the version of new deployments
 	// or to alter existing deployments.
-	// value will be sanitized (lowercase, replace non-alphanumeric with `-`, max 63 chars)
+	// value will be sanitized to follow the App Engine naming rules (lowercase,
+	// replace non-alphanumeric with `-`, no leading or trailing `-`, no reserved names,
+	// max 63 chars with a hash suffix if truncated)
 	Version string `json:"version"`
+	// VersionTemplate builds the version from Drone build metadata instead, for
+	// example `{{ .Branch }}-{{ .ShortSHA }}-{{ .BuildNumber }}`. See DroneMeta for
+	// the available fields. The result is sanitized just like Version.
+	VersionTemplate string `json:"version_template"`
 	// Service is used to set the service to be deployed
 	Service string `json:"service"`
-	// AEEnv allows users to set additional environment variables with `appcfg.py -E`
-	// in their App Engine environment. This can be useful for injecting
-	// secrets from your Drone secret store. No effect with `gcloud` commands.
+	// AEEnv allows users to set additional environment variables in their App Engine
+	// environment. This can be useful for injecting secrets from your Drone secret
+	// store. With `gcloud app deploy` they are merged into the `env_variables` of the
+	// rendered app.yaml, with `appcfg.py` they are passed with `-E`.
+	// Values may be Secret Manager references, like TemplateVars.
 	AEEnv map[string]string `json:"ae_environment"`
+	// AEEnvConflict decides what happens when an AEEnv variable is already set in the
+	// app.yaml `env_variables`: "override" (default) uses the AEEnv value, "keep" uses
+	// the app.yaml value and "error" fails the deploy.
+	AEEnvConflict string `json:"ae_environment_conflict"`
 	// SubCommands are optionally used with `gcloud app` Actions to produce
 	// complex commands like `gcloud app instances delete ...`.
 	SubCommands []string `json:"sub_commands"`
@@ -58,7 +75,38 @@ type GAE struct {
 	// various yaml configuration files. To use, the keys in this map must be referenced
 	// in the yaml files with Go's templating syntax. For example, the key "ABC" would be
 	// referenced with {{ .ABC }}.
+	// Values like `sm://projects/p/secrets/name/versions/latest` (or `sm://name`) are
+	// replaced with the Secret Manager secret they reference.
+	// Drone build metadata is always available as {{ .Drone.SHA }}, {{ .Drone.Branch }}
+	// etc., and the resolved plugin settings as {{ .Plugin.Project }}, {{ .Plugin.Service }}
+	// and {{ .Plugin.Version }}.
 	TemplateVars map[string]interface{} `json:"vars"`
+	// PublicVars lists the TemplateVars whose values aren't secret. All other values
+	// are masked in the logs. Values resolved from Secret Manager are always masked.
+	PublicVars []string `json:"public_vars"`
+
+	// VarsFiles is an optional list of YAML, JSON or dotenv (*.env) files, relative to
+	// Dir, to read TemplateVars from. Files are merged in order, so later files win.
+	VarsFiles []string `json:"vars_files"`
+	// VarsEnvPrefix turns every environment variable starting with the prefix into a
+	// template variable, without the prefix. With "DEPLOY_", DEPLOY_HOST becomes {{ .HOST }}.
+	// These win over VarsFiles, and TemplateVars win over both.
+	VarsEnvPrefix string `json:"vars_from_env_prefix"`
+
+	// Templates is an optional list of extra files to render with TemplateVars before
+	// the action runs, such as `.gcloudignore`, an Endpoints `openapi.yaml` or a config
+	// file bundled into the app. Paths are relative to Dir and dest must differ from src.
+	Templates []TemplateFile `json:"templates"`
+
+	// SecretManagerEndpoint overrides the Secret Manager API used to resolve `sm://`
+	// references in TemplateVars and AEEnv. Defaults to https://secretmanager.googleapis.com
+	SecretManagerEndpoint string `json:"secret_manager_endpoint"`
+
+	// TemplateEscape controls how string TemplateVars are inserted into the yaml files.
+	// By default they are inserted as-is. With "yaml", every string is inserted as a
+	// double quoted YAML string, so values containing `:`, `#` or newlines can't break
+	// or silently change the rendered file.
+	TemplateEscape string `json:"template_escape"`
 
 	// AppFile is the name of the app.yaml file to use for this deployment. This field
 	// is only required if your app.yaml file is not named 'app.yaml'. Sometimes it is
@@ -66,14 +114,34 @@ type GAE struct {
 	// and autoscaling configurations.
 	AppFile string `json:"app_file"`
 
+	// SkipValidation turns off the check of app.yaml against the plugin's built-in
+	// schema of App Engine keys before deploying. This may be needed if App Engine
+	// adds keys the plugin doesn't know about yet.
+	SkipValidation bool `json:"skip_validation"`
+
 	// MaxVersions is an optional value that can be used along with the "deploy" or
 	// "update" actions. If set to a non-zero value, the plugin will look up the versions
 	// of the deployed service and delete any older versions beyond the "max" value
 	// provided. If any of the "older" versions that should be deleted are actually
 	// serving traffic, they will not be deleted. This may result in the actual version
 	// count being higher than the max listed here.
+	// The service is taken from the `service` setting or, if that is empty, from the
+	// rendered app.yaml. If the service can't be determined, nothing is deleted.
 	MaxVersions int `json:"max_versions"`
 
+	// MaxRunningVersions is an optional value that can be used along with MaxVersions
+	// for a two-tier retention model, mostly useful in the flexible environment where
+	// idle versions still cost money. Versions beyond this count are stopped with
+	// `gcloud app versions stop` but kept around for a fast rollback; only versions
+	// beyond MaxVersions are deleted. Versions serving traffic are never stopped.
+	MaxRunningVersions int `json:"max_running_versions"`
+
+	// ProtectedVersions is an optional list of version names that will never be
+	// deleted by MaxVersions, even when they serve no traffic. Entries may be shell
+	// patterns (ex: `hotfix-*`, `rollback-*`). App Engine versions can't carry labels,
+	// so a naming convention like this is how versions are marked as protected.
+	ProtectedVersions []string `json:"protected_versions"`
+
 	// CronFile is the name of the cron.yaml file to use for this deployment. This field
 	// is only required if your cron.yaml file is not named 'cron.yaml' or if you
 	// want to use the `action: deploy` configuration to deploy a cron.yaml change.
@@ -89,6 +157,28 @@ type GAE struct {
 	// This field is deprecated and will no longer work come Oct 2019.
 	QueueFile string `json:"queue_file"`
 
+	// FirewallFile is the yaml file describing the App Engine firewall rules for the
+	// "firewall-sync" action. Defaults to firewall.yaml. Templated like the other files.
+	FirewallFile string `json:"firewall_file"`
+	// DomainsFile is the yaml file describing the custom domain mappings and their SSL
+	// certificates for the "domains-sync" action. Defaults to domains.yaml.
+	DomainsFile string `json:"domains_file"`
+	// DryRun prints the changes the "firewall-sync" and "domains-sync" actions would
+	// make without applying them.
+	DryRun bool `json:"dry_run"`
+
+	// Preview deploys a version named after the pull request (pr-NUMBER) or branch
+	// (preview-BRANCH) without promoting it. When Drone reports the pull request was
+	// closed, the preview version is deleted instead.
+	Preview bool `json:"preview"`
+
+	// EnsureApp creates the App Engine application in Region before running the action
+	// if the project doesn't have one yet. Only works with `gcloud` commands.
+	EnsureApp bool `json:"ensure_app"`
+	// Region is where EnsureApp and the create action create the application
+	// (ex: us-central). It can't be changed once the application exists.
+	Region string `json:"region"`
+
 	// Dir points to the directory the application exists in. This is only required if
 	// you application is not in the base directory.
 	Dir string `json:"dir"`
@@ -106,9 +196,68 @@ type GAE struct {
 	// tool. This may be useful if using a custom image.
 	// This field is deprecated and will no longer work come Oct 2019.
 	AppCfgCmd string `json:"appcfg_cmd"`
+	// LegacyAppCfg passes actions gcloud doesn't know about to appcfg.py instead of
+	// failing. Without it, update, update_cron, update_dispatch and set_default_version
+	// are translated to their gcloud equivalents.
+	LegacyAppCfg bool `json:"legacy_appcfg"`
+
+	// SmokeTests is an optional list of HTTP checks to run against the newly deployed
+	// version after a "deploy" or "update" action. Any failing check fails the step.
+	SmokeTests []SmokeTest `json:"smoke_tests"`
+	// SmokeBaseURL overrides the URL smoke tests are run against. By default this is
+	// the version specific URL gcloud reports for the deploy.
+	SmokeBaseURL string `json:"smoke_base_url"`
+	// SmokeRetries is how many times a failing smoke test is retried before giving up,
+	// to allow for new instances to start. Defaults to 5.
+	SmokeRetries int `json:"smoke_retries"`
+	// SmokeRetryDelay is how long to wait between smoke test retries. Defaults to 5s.
+	SmokeRetryDelay string `json:"smoke_retry_delay"`
+	// SmokeRollback will move traffic back to the versions that were serving before
+	// the deploy if any smoke test fails.
+	SmokeRollback bool `json:"smoke_rollback"`
+
+	// Lock makes deploys of the same project and service wait for each other. It is
+	// either a Cloud Storage location (gs://bucket/prefix) or a local directory.
+	Lock string `json:"lock"`
+	// LockTimeout is how long to wait for the lock before failing. Defaults to 10m.
+	LockTimeout string `json:"lock_timeout"`
+	// LockStaleAfter is how old a lock can get before it is assumed to be left over
+	// from a crashed build and is broken. Defaults to 1h, 0 never breaks locks.
+	LockStaleAfter string `json:"lock_stale_after"`
+
+	// Notify sends webhooks (Slack or generic JSON) when a deploy starts, succeeds,
+	// fails or is rolled back.
+	Notify Notify `json:"notify"`
+
+	// ResultFile is an optional path, relative to the workspace, where a JSON summary
+	// of the deployment is written for later pipeline steps: project, service,
+	// version, version URL, previously serving versions, removed versions and the
+	// timing of each command run.
+	ResultFile string `json:"result_file"`
+	// ResultEnvFile is like ResultFile, but written in dotenv format (GAE_VERSION=...)
+	// so it can be sourced by shell steps.
+	ResultEnvFile string `json:"result_env_file"`
+
+	// Verbosity is passed along to gcloud as `--verbosity` (debug, info, warning, error,
+	// critical or none).
+	Verbosity string `json:"verbosity"`
 
 	// Beta is used by the gcloud command suite. If set, `gcloud beta app` will be used.
 	Beta bool `json:"beta"`
+
+	// stageDir is where user-supplied yaml files are rendered for gcloud actions, so
+	// the files in the workspace are left untouched. It is set by wrapMain. When it
+	// is empty, files are rendered in place.
+	stageDir string
+	// resolvedSecrets are the values fetched from Secret Manager, which are always
+	// masked in the logs. It is set by wrapMain.
+	resolvedSecrets []string
+}
+
+// TemplateFile is an extra file rendered with TemplateVars.
+type TemplateFile struct {
+	Src  string `json:"src"`
+	Dest string `json:"dest"`
 }
 
 func main() {
@@ -146,7 +295,7 @@ func wrapMain() error {
 		}
 	}
 
-	err := validateVargs(&vargs)
+	err := prepareVargs(workspace, &vargs)
 	if err != nil {
 		return err
 	}
@@ -176,27 +325,179 @@ func wrapMain() error {
 	runner := NewEnviron(filepath.Join(workspace, vargs.Dir), os.Environ(),
 		os.Stdout, os.Stderr)
 
+	// keep any secrets we know about out of the build logs
+	runner.secrets = newRedactor(secretValues(vargs)...)
+
+	// render yaml files for gcloud into a scratch directory, keeping the workspace
+	// pristine. appcfg.py can only deploy an app.yaml that sits in the app directory.
+	if _, ok := gcloudActions[vargs.Action]; ok {
+		vargs.stageDir, err = ioutil.TempDir("", "drone-gae")
+		if err != nil {
+			return fmt.Errorf("error creating staging directory: %s\n", err)
+		}
+		defer os.RemoveAll(vargs.stageDir)
+	}
+
 	// setup gcloud with our service account so we can use it for an access token
 	err = runner.Run(vargs.GCloudCmd, "auth", "activate-service-account", "--key-file", keyPath)
 	if err != nil {
 		return fmt.Errorf("error: %s\n", err)
 	}
 
+	// swap any Secret Manager references for the secrets before rendering templates
+	if hasSecretRefs(vargs) {
+		token, err := accessToken(runner, vargs)
+		if err != nil {
+			return err
+		}
+		sr := newSecretResolver(vargs.SecretManagerEndpoint, vargs.Project, token)
+		resolved, err := resolveSecretRefs(&vargs, sr)
+		if err != nil {
+			return fmt.Errorf("error: %s\n", err)
+		}
+		runner.secrets.add(resolved...)
+		vargs.resolvedSecrets = resolved
+	}
+
+	res := &Result{Project: vargs.Project, Version: vargs.Version}
+	isDeploy := vargs.Action == "deploy" || vargs.Action == "update"
+
+	err = runAction(runner, workspace, vargs, res)
+
+	if isDeploy {
+		if err != nil {
+			notify(vargs, "failure", res, err)
+		} else {
+			notify(vargs, "success", res, nil)
+		}
+		if res.RolledBack {
+			notify(vargs, "rollback", res, err)
+		}
+	}
+
+	// write out what we did, even on failure, so later pipeline steps can use it
+	res.Commands = runner.commands
+	if werr := writeResult(workspace, vargs, res, err); werr != nil {
+		if err != nil {
+			fmt.Printf("warning: %s\n", werr)
+		} else {
+			err = werr
+		}
+	}
+
+	return err
+}
+
+// runAction renders the yaml files, runs the requested action and any
+// post-deploy steps, recording what happened in res.
+func runAction(runner *Environ, workspace string, vargs GAE, res *Result) error {
+	isDeploy := vargs.Action == "deploy" || vargs.Action == "update"
+
+	// gcloud only takes environment variables from app.yaml, so stage a copy of
+	// app.yaml we can merge the AEEnv into
+	mergeEnv := isDeploy && vargs.stageDir != "" && len(vargs.AEEnv) > 0 &&
+		vargs.DispatchFile == "" && vargs.CronFile == ""
+	if mergeEnv && vargs.AppFile == "" {
+		vargs.AppFile = "app.yaml"
+	}
+
+	// a brand new project needs an application before anything can be deployed
+	if vargs.EnsureApp && vargs.stageDir != "" {
+		err := ensureApp(runner, vargs)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := setupFiles(workspace, vargs)
+	if err != nil {
+		return err
+	}
+
+	if mergeEnv {
+		err = mergeAEEnv(workspace, vargs)
+		if err != nil {
+			return err
+		}
+	}
+	if isDeploy {
+		res.setService(workspace, vargs)
+	}
+
+	// catch app.yaml mistakes before waiting on a Cloud Build to fail
+	if isDeploy && !vargs.SkipValidation && vargs.DispatchFile == "" && vargs.CronFile == "" {
+		err = validateAppFile(workspace, vargs)
+		if err != nil {
+			return err
+		}
+	}
+
+	// only one deploy of a service at a time, held until old versions are cleaned up
+	if isDeploy && vargs.Lock != "" {
+		unlock, err := acquireDeployLock(runner, workspace, vargs)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	// remember which versions served traffic so a failed smoke test can roll back
+	var previous []versionInfo
+	if isDeploy && (vargs.ResultFile != "" || vargs.ResultEnvFile != "" ||
+		(vargs.SmokeRollback && len(vargs.SmokeTests) > 0)) {
+		previous, err = servingVersions(runner, workspace, vargs)
+		if err != nil {
+			fmt.Printf("warning: unable to look up serving versions: %s\n", err)
+		}
+		for _, v := range previous {
+			res.PreviousVersions = append(res.PreviousVersions, v.ID)
+		}
+	}
+
+	// only announce the deploy once it's no longer waiting on the lock
+	if isDeploy {
+		notify(vargs, "start", res, nil)
+	}
+
 	// if gcloud app cmd or group, run it
-	if gcloudCmds[vargs.Action] || gcloudGroups[vargs.Action] {
-		err = runGcloud(runner, workspace, vargs)
+	if _, ok := gcloudActions[vargs.Action]; ok {
+		err = runGcloud(runner, workspace, vargs, res)
 	} else {
 		// otherwise, do appcfg.py command
 		err = runAppCfg(runner, workspace, vargs)
 	}
 
+	// gcloud picks a version name when none is given, so use the one it reports
+	if isDeploy && res.Deploy != nil {
+		if vargs.Version == "" {
+			vargs.Version = res.Deploy.Version
+		}
+		res.Version = vargs.Version
+		res.setService(workspace, vargs)
+		if res.Deploy.VersionURL != "" {
+			res.VersionURL = res.Deploy.VersionURL
+		}
+	}
+
 	if err != nil {
 		return err
 	}
 
-	// check if MaxVersions is supplied + deploy action
-	if vargs.MaxVersions > 0 && (vargs.Action == "deploy" || vargs.Action == "update") {
-		return removeOldVersions(runner, workspace, vargs)
+	if isDeploy && vargs.Preview && res.VersionURL != "" {
+		fmt.Printf("preview URL: %s\n", res.VersionURL)
+	}
+
+	if isDeploy && len(vargs.SmokeTests) > 0 {
+		err = smokeTest(runner, workspace, vargs, previous, res)
+		if err != nil {
+			return err
+		}
+	}
+
+	// check if MaxVersions or MaxRunningVersions is supplied + deploy action.
+	// previews clean up after themselves.
+	if (vargs.MaxVersions > 0 || vargs.MaxRunningVersions > 0) && isDeploy && !vargs.Preview {
+		return removeOldVersions(runner, workspace, vargs, res)
 	}
 
 	return nil
@@ -220,6 +521,9 @@ type dummyGAE struct {
 	AddlArgs     map[string]string      `json:"-"`
 	AEEnv        map[string]string      `json:"-"`
 	TemplateVars map[string]interface{} `json:"-"`
+	SmokeTests   []SmokeTest            `json:"-"`
+	Templates    []TemplateFile         `json:"-"`
+	Notify       Notify                 `json:"-"`
 }
 
 func configFromEnv(vargs *GAE, workspace *string) error {
@@ -232,10 +536,17 @@ func configFromEnv(vargs *GAE, workspace *string) error {
 
 	vargs.Action = os.Getenv("PLUGIN_ACTION")
 	vargs.Version = os.Getenv("PLUGIN_VERSION")
+	vargs.VersionTemplate = os.Getenv("PLUGIN_VERSION_TEMPLATE")
 	vargs.Service = os.Getenv("PLUGIN_SERVICE")
 	vargs.FlexImage = os.Getenv("PLUGIN_FLEX_IMAGE")
+	vargs.AEEnvConflict = os.Getenv("PLUGIN_AE_ENVIRONMENT_CONFLICT")
 	vargs.AppFile = os.Getenv("PLUGIN_APP_FILE")
+	vargs.TemplateEscape = os.Getenv("PLUGIN_TEMPLATE_ESCAPE")
+	vargs.VarsEnvPrefix = os.Getenv("PLUGIN_VARS_FROM_ENV_PREFIX")
+	vargs.SecretManagerEndpoint = os.Getenv("PLUGIN_SECRET_MANAGER_ENDPOINT")
+	vargs.SkipValidation = os.Getenv("PLUGIN_SKIP_VALIDATION") == "true"
 	vargs.MaxVersions, _ = strconv.Atoi(os.Getenv("PLUGIN_MAX_VERSIONS"))
+	vargs.MaxRunningVersions, _ = strconv.Atoi(os.Getenv("PLUGIN_MAX_RUNNING_VERSIONS"))
 	vargs.CronFile = os.Getenv("PLUGIN_CRON_FILE")
 	vargs.DispatchFile = os.Getenv("PLUGIN_DISPATCH_FILE")
 	vargs.QueueFile = os.Getenv("PLUGIN_QUEUE_FILE")
@@ -244,6 +555,23 @@ func configFromEnv(vargs *GAE, workspace *string) error {
 	vargs.GCloudCmd = os.Getenv("PLUGIN_GCLOUD_CMD")
 	vargs.AppCfgCmd = os.Getenv("PLUGIN_APPCFG_CMD")
 	vargs.Beta = os.Getenv("PLUGIN_BETA") == "true"
+	vargs.LegacyAppCfg = os.Getenv("PLUGIN_LEGACY_APPCFG") == "true"
+	vargs.FirewallFile = os.Getenv("PLUGIN_FIREWALL_FILE")
+	vargs.DomainsFile = os.Getenv("PLUGIN_DOMAINS_FILE")
+	vargs.DryRun = os.Getenv("PLUGIN_DRY_RUN") == "true"
+	vargs.EnsureApp = os.Getenv("PLUGIN_ENSURE_APP") == "true"
+	vargs.Preview = os.Getenv("PLUGIN_PREVIEW") == "true"
+	vargs.Lock = os.Getenv("PLUGIN_LOCK")
+	vargs.LockTimeout = os.Getenv("PLUGIN_LOCK_TIMEOUT")
+	vargs.LockStaleAfter = os.Getenv("PLUGIN_LOCK_STALE_AFTER")
+	vargs.Region = os.Getenv("PLUGIN_REGION")
+	vargs.Verbosity = os.Getenv("PLUGIN_VERBOSITY")
+	vargs.ResultFile = os.Getenv("PLUGIN_RESULT_FILE")
+	vargs.ResultEnvFile = os.Getenv("PLUGIN_RESULT_ENV_FILE")
+	vargs.SmokeBaseURL = os.Getenv("PLUGIN_SMOKE_BASE_URL")
+	vargs.SmokeRetries, _ = strconv.Atoi(os.Getenv("PLUGIN_SMOKE_RETRIES"))
+	vargs.SmokeRetryDelay = os.Getenv("PLUGIN_SMOKE_RETRY_DELAY")
+	vargs.SmokeRollback = os.Getenv("PLUGIN_SMOKE_ROLLBACK") == "true"
 
 	vargs.Token = os.Getenv("PLUGIN_GAE_CREDENTIALS")
 	if vargs.Token == "" {
@@ -301,13 +629,58 @@ func configFromEnv(vargs *GAE, workspace *string) error {
 		vargs.TemplateVars = dummyVargs.TemplateVars
 	}
 
+	templates := os.Getenv("PLUGIN_TEMPLATES")
+	if templates != "" {
+		if err := json.Unmarshal([]byte(templates), &dummyVargs.Templates); err != nil {
+			return fmt.Errorf("could not parse param templates into a list of src/dest pairs")
+		}
+		vargs.Templates = dummyVargs.Templates
+	}
+
+	smokeTests := os.Getenv("PLUGIN_SMOKE_TESTS")
+	if smokeTests != "" {
+		if err := json.Unmarshal([]byte(smokeTests), &dummyVargs.SmokeTests); err != nil {
+			return fmt.Errorf("could not parse param smoke_tests into a list of smoke tests")
+		}
+		vargs.SmokeTests = dummyVargs.SmokeTests
+	}
+
+	notifyConfig := os.Getenv("PLUGIN_NOTIFY")
+	if notifyConfig != "" {
+		if err := json.Unmarshal([]byte(notifyConfig), &dummyVargs.Notify); err != nil {
+			return fmt.Errorf("could not parse param notify into a list of webhooks")
+		}
+		vargs.Notify = dummyVargs.Notify
+	}
+
 	// Lists: pity the fool whose values include commas
 	vargs.AddlFlags = strings.Split(os.Getenv("PLUGIN_ADDL_FLAGS"), ",")
+	vargs.SecretArgs = strings.Split(os.Getenv("PLUGIN_SECRET_ARGS"), ",")
+	vargs.PublicVars = strings.Split(os.Getenv("PLUGIN_PUBLIC_VARS"), ",")
 	vargs.SubCommands = strings.Split(os.Getenv("PLUGIN_SUB_COMMANDS"), ",")
+	vargs.ProtectedVersions = strings.Split(os.Getenv("PLUGIN_PROTECTED_VERSIONS"), ",")
+	vargs.VarsFiles = strings.Split(os.Getenv("PLUGIN_VARS_FILES"), ",")
 
 	return nil
 }
 
+// prepareVargs merges the template vars, then validates vargs and routes the
+// action. version_template and the notify messages are checked during
+// validation, so they need every var source merged already.
+func prepareVargs(workspace string, vargs *GAE) error {
+	err := loadTemplateVars(workspace, vargs)
+	if err != nil {
+		return err
+	}
+
+	err = validateVargs(vargs)
+	if err != nil {
+		return err
+	}
+
+	return routeAction(vargs)
+}
+
 func validateVargs(vargs *GAE) error {
 
 	if vargs.Token == "" {
@@ -333,31 +706,96 @@ func validateVargs(vargs *GAE) error {
 		vargs.GCloudCmd = "gcloud"
 	}
 
+	if vargs.EnsureApp && vargs.Region == "" {
+		return fmt.Errorf("missing required param region for ensure_app")
+	}
+
+	if vargs.Action == "firewall-sync" && vargs.FirewallFile == "" {
+		vargs.FirewallFile = "firewall.yaml"
+	}
+
+	if vargs.Action == "domains-sync" && vargs.DomainsFile == "" {
+		vargs.DomainsFile = "domains.yaml"
+	}
+
+	err := setupPreview(vargs, droneMetadata(os.Getenv))
+	if err != nil {
+		return err
+	}
+
+	if vargs.VersionTemplate != "" {
+		if vargs.Version != "" {
+			return fmt.Errorf("params version and version_template can't be used together")
+		}
+		v, err := renderVersion(*vargs)
+		if err != nil {
+			return err
+		}
+		if v == "" {
+			return fmt.Errorf("version_template rendered an empty version")
+		}
+		vargs.Version = v
+	}
+
 	if vargs.Version != "" {
-		v := strings.ToLower(vargs.Version)
-		if len(v) > 63 {
-			v = v[:63]
+		v, err := sanitizeVersion(vargs.Version)
+		if err != nil {
+			return err
+		}
+		if v != vargs.Version {
+			fmt.Printf("using version %q (from %q)\n", v, vargs.Version)
+		} else {
+			fmt.Printf("using version %q\n", v)
 		}
-		re := regexp.MustCompile(`[^a-z\d-]`)
-		vargs.Version = re.ReplaceAllString(v, "-")
+		vargs.Version = v
 	}
 
-	return nil
-}
+	if err := validateSmokeTests(vargs); err != nil {
+		return err
+	}
+
+	if err := validateNotify(vargs); err != nil {
+		return err
+	}
 
-// Gcloud Groups
-var gcloudGroups = map[string]bool{
-	"services":  true,
-	"versions":  true,
-	"instances": true,
+	return validateLock(vargs)
 }
 
-// Gcloud Commands
-var gcloudCmds = map[string]bool{
-	"deploy": true,
+func runGcloud(runner *Environ, workspace string, vargs GAE, res *Result) error {
+	action := gcloudActions[vargs.Action]
+
+	// some actions don't need gcloud at all
+	if action.local != nil {
+		return action.local(runner, workspace, vargs)
+	}
+
+	args := gcloudArgs(workspace, vargs)
+
+	if !action.deploy {
+		err := runner.Run(vargs.GCloudCmd, args...)
+		if err != nil {
+			return fmt.Errorf("error: %s\n", err)
+		}
+		return nil
+	}
+
+	// capture the deploy output so we can pull the interesting bits out of it,
+	// even (especially) when the deploy fails
+	stdout, stderr, err := runner.Capture(vargs.GCloudCmd, args...)
+	out := parseDeployOutput(stdout, stderr)
+	out.log()
+	res.Deploy = &out
+	if err != nil {
+		return fmt.Errorf("error: %s\n", err)
+	}
+	return nil
 }
 
-func runGcloud(runner *Environ, workspace string, vargs GAE) error {
+// gcloudArgs builds the arguments to gcloud for the action, passing the
+// version and service the way that action expects them.
+func gcloudArgs(workspace string, vargs GAE) []string {
+	action := gcloudActions[vargs.Action]
+
 	var args []string
 
 	// if beta, add that command first so we get `gcloud beta ...`
@@ -366,10 +804,11 @@ func runGcloud(runner *Environ, workspace string, vargs GAE) error {
 	}
 
 	// add the app action (gcloud app X)
-	args = append(args, []string{
-		"app",
-		vargs.Action,
-	}...)
+	command := vargs.Action
+	if action.command != "" {
+		command = action.command
+	}
+	args = append(args, "app", command)
 
 	// Add subcommands to we can make complex calls like
 	// 'gcloud app services X Y Z ...'
@@ -379,42 +818,37 @@ func runGcloud(runner *Environ, workspace string, vargs GAE) error {
 		}
 	}
 
-	// hook in the appropriate yaml file unless the action is a group
+	// hook in the appropriate yaml file when deploying
 	// 'gcloud app services X Y Z' fails with the addition of a yaml file
-	if !gcloudGroups[vargs.Action] {
+	if action.deploy {
 		switch {
 		case vargs.DispatchFile != "":
-			args = append(args, "./dispatch.yaml")
+			args = append(args, deployable(workspace, vargs, "dispatch.yaml", vargs.DispatchFile))
 		case vargs.CronFile != "":
-			args = append(args, "./cron.yaml")
+			args = append(args, deployable(workspace, vargs, "cron.yaml", vargs.CronFile))
+		case vargs.stageDir != "" && vargs.AppFile != "":
+			// the app is deployed from its directory in the workspace, but with
+			// the rendered copy of the app file
+			args = append(args, "./"+vargs.AppFile, "--appyaml", appFilePath(workspace, vargs))
 		default:
 			args = append(args, "./app.yaml")
 		}
 	}
 
-	// add a version if we've got one
-	// (requires passing args differently based on whether it's a group or plain command)
+	// add a version and service if we've got them and the action takes them
 	if vargs.Version != "" {
-		if gcloudCmds[vargs.Action] {
-			args = append(args, "--version", vargs.Version)
-		} else {
-			// it's a gcloud command for a group, treat it differently
-			args = append(args, vargs.Version)
-		}
+		args = action.version.append(args, "--version", vargs.Version)
 	}
-
-	// add a service if we've got one
-	// (requires passing args differently based on whether it's a group or plain command)
 	if vargs.Service != "" {
-		if gcloudCmds[vargs.Action] {
-			args = append(args, "--service", vargs.Service)
-		} else {
-			// it's a gcloud command for a group, treat it differently
-			args = append(args, vargs.Service)
-		}
+		args = action.service.append(args, "--service", vargs.Service)
+	}
+
+	// an explicit --region in addl_args or addl_flags wins
+	if vargs.Region != "" && !hasFlag(vargs, "--region") {
+		args = action.region.append(args, "--region", vargs.Region)
 	}
 
-	if vargs.FlexImage != "" {
+	if vargs.FlexImage != "" && action.deploy {
 		args = append(args, "--image-url", vargs.FlexImage)
 	}
 
@@ -424,6 +858,16 @@ func runGcloud(runner *Environ, workspace string, vargs GAE) error {
 
 	// add flag to prevent interactive
 	args = append(args, "--quiet")
+	args = append(args, action.flags...)
+
+	// ask for machine readable deploy results, unless the user wants another format
+	if action.deploy && !hasFlag(vargs, "--format") {
+		args = append(args, "--format", "json")
+	}
+
+	if vargs.Verbosity != "" {
+		args = append(args, "--verbosity", vargs.Verbosity)
+	}
 
 	// add the remaining arguments
 	if len(vargs.AddlArgs) > 0 {
@@ -441,42 +885,33 @@ func runGcloud(runner *Environ, workspace string, vargs GAE) error {
 		}
 	}
 
-	if err := setupAppFile(workspace, vargs); err != nil {
-		return err
-	}
-
-	if err := setupCronFile(workspace, vargs); err != nil {
-		return err
-	}
-
-	if err := setupDispatchFile(workspace, vargs); err != nil {
-		return err
-	}
+	return args
+}
 
-	if err := setupQueueFile(workspace, vargs); err != nil {
-		return err
+// hasFlag reports whether the user already passed the given flag through
+// AddlArgs or AddlFlags.
+func hasFlag(vargs GAE, flag string) bool {
+	if _, ok := vargs.AddlArgs[flag]; ok {
+		return true
 	}
-
-	err := runner.Run(vargs.GCloudCmd, args...)
-	if err != nil {
-		return fmt.Errorf("error: %s\n", err)
+	for _, f := range vargs.AddlFlags {
+		if f == flag || strings.HasPrefix(f, flag+"=") {
+			return true
+		}
 	}
-	return nil
+	return false
 }
 
 func runAppCfg(runner *Environ, workspace string, vargs GAE) error {
 	// get access token string to pass along to `appcfg.py`
-	tokenCmd := exec.Command(vargs.GCloudCmd, "auth", "print-access-token")
-	var accessToken bytes.Buffer
-	tokenCmd.Stdout = &accessToken
-	err := tokenCmd.Run()
+	token, err := accessToken(runner, vargs)
 	if err != nil {
-		return fmt.Errorf("error creating access token: %s\n", err)
+		return err
 	}
 
 	// build initial args for appcfg command
 	args := []string{
-		"--oauth2_access_token", accessToken.String(),
+		"--oauth2_access_token", token,
 		"-A", vargs.Project,
 	}
 
@@ -502,14 +937,6 @@ func runAppCfg(runner *Environ, workspace string, vargs GAE) error {
 	// add action and current dir
 	args = append(args, vargs.Action, ".")
 
-	if err = setupAppFile(workspace, vargs); err != nil {
-		return err
-	}
-
-	if err = setupCronFile(workspace, vargs); err != nil {
-		return err
-	}
-
 	err = runner.Run(vargs.AppCfgCmd, args...)
 	if err != nil {
 		return fmt.Errorf("error: %s\n", err)
@@ -531,6 +958,36 @@ func getProjectFromToken(j string) string {
 	return t.ProjectID
 }
 
+// setupFiles puts all of the user-supplied yaml files in place and renders
+// them with any TemplateVars.
+func setupFiles(workspace string, vargs GAE) error {
+	if err := setupAppFile(workspace, vargs); err != nil {
+		return err
+	}
+
+	if err := setupCronFile(workspace, vargs); err != nil {
+		return err
+	}
+
+	if err := setupDispatchFile(workspace, vargs); err != nil {
+		return err
+	}
+
+	if err := setupQueueFile(workspace, vargs); err != nil {
+		return err
+	}
+
+	if err := setupFirewallFile(workspace, vargs); err != nil {
+		return err
+	}
+
+	if err := setupDomainsFile(workspace, vargs); err != nil {
+		return err
+	}
+
+	return setupTemplates(workspace, vargs)
+}
+
 // some app engine commands are weird and require the app file to be named
 // 'app.yaml'. If an app file is given and it does not equal that, we need
 // to copy it there
@@ -553,50 +1010,144 @@ func setupQueueFile(workspace string, vargs GAE) error {
 	return setupFile(workspace, vargs, "queue.yaml", vargs.QueueFile)
 }
 
+// The rules for the firewall-sync action
+func setupFirewallFile(workspace string, vargs GAE) error {
+	return setupFile(workspace, vargs, "firewall.yaml", vargs.FirewallFile)
+}
+
+// The domain mappings for the domains-sync action
+func setupDomainsFile(workspace string, vargs GAE) error {
+	return setupFile(workspace, vargs, "domains.yaml", vargs.DomainsFile)
+}
+
 // setupFile is used to copy a user-supplied file to a GAE-expected file.
 // gaeName is the file name that GAE uses (ex: app.yaml, cron.yaml, default.yaml)
 // suppliedName is the name of the file that should be renamed (ex: stg-app.yaml)
 // If any template variables are provided, the file will be parsed and executed as
 // a text/template with the variables injected.
+// The result is written to the staging directory if there is one, otherwise the
+// workspace copy is overwritten.
 func setupFile(workspace string, vargs GAE, gaeName string, suppliedName string) error {
 	// if no file given, give up
 	if suppliedName == "" {
 		return nil
 	}
-	dest := filepath.Join(workspace, vargs.Dir, gaeName)
-	if suppliedName != gaeName {
-		orig := filepath.Join(workspace, vargs.Dir, suppliedName)
+	orig := filepath.Join(workspace, vargs.Dir, suppliedName)
+	dest := renderedFile(workspace, vargs, gaeName, suppliedName)
+	if vargs.stageDir == "" && suppliedName != gaeName {
 		err := copyFile(dest, orig)
 		if err != nil {
 			return fmt.Errorf("error moving %q to %q: %s\n", suppliedName, gaeName, err)
 		}
+		orig = dest
 	}
 
-	// now that the file is in the right spot, we can inject any available TemplateVars.
-	blob, err := ioutil.ReadFile(dest)
+	// now that we know where the file is going, we can inject any available TemplateVars.
+	return renderFile(orig, dest, gaeName, vargs)
+}
+
+// renderFile executes the template in src with the TemplateVars and writes the
+// result to dest. name is used in error messages and to decide whether the
+// result should be checked as YAML.
+func renderFile(src, dest, name string, vargs GAE) error {
+	blob, err := ioutil.ReadFile(src)
 	if err != nil {
 		return fmt.Errorf("error reading template: %s\n", err)
 	}
 
-	tmpl, err := template.New(gaeName).Option("missingkey=error").Parse(string(blob))
+	vars, err := templateVars(vargs, name)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.New(name).
+		Funcs(templateFuncs(vars)).
+		Option("missingkey=error").
+		Parse(string(blob))
 	if err != nil {
 		return fmt.Errorf("error parsing template: %s\n", err)
 	}
 
-	out, err := os.OpenFile(dest, os.O_TRUNC|os.O_RDWR, 0755)
+	var rendered bytes.Buffer
+	err = tmpl.Execute(&rendered, vars)
+	if err != nil {
+		return fmt.Errorf("error executing template: %s\n", err)
+	}
+
+	// make sure we're not about to deploy broken (or silently different) yaml
+	err = checkRenderedYAML(name, rendered.Bytes(), vargs)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0755)
 	if err != nil {
 		return fmt.Errorf("error opening template: %s\n", err)
 	}
 	defer out.Close()
 
-	err = tmpl.Execute(out, vargs.TemplateVars)
+	_, err = out.Write(rendered.Bytes())
 	if err != nil {
-		return fmt.Errorf("error executing template: %s\n", err)
+		return fmt.Errorf("error writing template: %s\n", err)
 	}
 
 	return nil
 }
 
+// setupTemplates renders the extra Templates into the app directory, so they
+// are deployed along with the app.
+func setupTemplates(workspace string, vargs GAE) error {
+	appDir := filepath.Join(workspace, vargs.Dir)
+	for _, t := range vargs.Templates {
+		if t.Src == "" || t.Dest == "" {
+			return fmt.Errorf("templates entries need both a src and a dest\n")
+		}
+
+		src := filepath.Join(appDir, t.Src)
+		dest := filepath.Join(appDir, t.Dest)
+		if src == dest {
+			return fmt.Errorf("template %q can't be rendered onto itself: use a different dest\n", t.Src)
+		}
+		if rel, err := filepath.Rel(workspace, dest); err != nil || strings.HasPrefix(rel, "..") {
+			return fmt.Errorf("template dest %q is outside of the workspace\n", t.Dest)
+		}
+
+		err := os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return fmt.Errorf("error creating directory for %q: %s\n", t.Dest, err)
+		}
+
+		err = renderFile(src, dest, t.Dest, vargs)
+		if err != nil {
+			return fmt.Errorf("error rendering %q to %q: %s", t.Src, t.Dest, err)
+		}
+	}
+	return nil
+}
+
+// renderedFile returns the path of the yaml file GAE should use for gaeName:
+// the rendered copy in the staging directory if suppliedName was staged,
+// otherwise the file in the app directory.
+func renderedFile(workspace string, vargs GAE, gaeName string, suppliedName string) string {
+	if vargs.stageDir != "" && suppliedName != "" {
+		return filepath.Join(vargs.stageDir, gaeName)
+	}
+	return filepath.Join(workspace, vargs.Dir, gaeName)
+}
+
+// appFilePath returns the path of the app.yaml being deployed.
+func appFilePath(workspace string, vargs GAE) string {
+	return renderedFile(workspace, vargs, "app.yaml", vargs.AppFile)
+}
+
+// deployable returns the argument to pass to `gcloud app deploy` for gaeName.
+func deployable(workspace string, vargs GAE, gaeName string, suppliedName string) string {
+	if vargs.stageDir != "" && suppliedName != "" {
+		return renderedFile(workspace, vargs, gaeName, suppliedName)
+	}
+	return "./" + gaeName
+}
+
 func copyFile(dst, src string) error {
 	in, err := os.Open(src)
 	if err != nil {
@@ -3,6 +3,7 @@ package main
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 
@@ -98,7 +99,7 @@ func TestValidateVargs(t *testing.T) {
 	// Project field overrides token
 	assert.Equal(t, "my-other-project", vargs.Project)
 
-	// sanitize version with trim
+	// sanitize version with trim, keeping a hash of the full name
 	vargs = GAE{
 		Token:   "mytoken",
 		Project: "myproject",
@@ -106,7 +107,7 @@ func TestValidateVargs(t *testing.T) {
 		Version: "feature/PRJ-test.branch/name-thatisreal23really@#$%&*longandgetstrimmed",
 	}
 	assert.NoError(t, validateVargs(&vargs))
-	assert.Equal(t, "feature-prj-test-branch-name-thatisreal23really------longandget", vargs.Version)
+	assert.Equal(t, "feature-prj-test-branch-name-thatisreal23really------lon-488ebf", vargs.Version)
 
 	// sanitize version short string
 	vargs = GAE{
@@ -129,6 +130,47 @@ func TestValidateVargs(t *testing.T) {
 	assert.NoError(t, validateVargs(&vargs))
 	assert.Equal(t, "version1", vargs.Version)
 	assert.Equal(t, "myservice", vargs.Service)
+
+	// version from a template
+	os.Setenv("DRONE_COMMIT_SHA", "0123456789abcdef")
+	os.Setenv("DRONE_COMMIT_BRANCH", "Feature/Thing")
+	os.Setenv("DRONE_BUILD_NUMBER", "42")
+	defer os.Unsetenv("DRONE_COMMIT_SHA")
+	defer os.Unsetenv("DRONE_COMMIT_BRANCH")
+	defer os.Unsetenv("DRONE_BUILD_NUMBER")
+	vargs = GAE{
+		Token:           "mytoken",
+		Project:         "myproject",
+		Action:          "dostuff",
+		VersionTemplate: "{{ .Branch }}-{{ .ShortSHA }}-{{ .BuildNumber }}",
+	}
+	assert.NoError(t, validateVargs(&vargs))
+	assert.Equal(t, "feature-thing-01234567-42", vargs.Version)
+
+	vargs = GAE{
+		Token:           "mytoken",
+		Project:         "myproject",
+		Action:          "dostuff",
+		Version:         "v1",
+		VersionTemplate: "{{ .Branch }}",
+	}
+	assert.EqualError(t, validateVargs(&vargs), "params version and version_template can't be used together")
+
+	vargs = GAE{
+		Token:   "mytoken",
+		Project: "myproject",
+		Action:  "dostuff",
+		Version: "@#$",
+	}
+	assert.Error(t, validateVargs(&vargs))
+
+	vargs = GAE{
+		Token:     "mytoken",
+		Project:   "myproject",
+		Action:    "dostuff",
+		EnsureApp: true,
+	}
+	assert.EqualError(t, validateVargs(&vargs), "missing required param region for ensure_app")
 }
 
 func TestSetupFile(t *testing.T) {
@@ -181,6 +223,37 @@ func TestSetupFile(t *testing.T) {
 				"No": "no",
 			},
 
+			wantError: true,
+		},
+		{
+			name: "helper functions",
+			givenContents: `env_variables:
+  NAME: {{ .Name | upper | quote }}
+  REGION: {{ get "Region" | default "us-east1" }}
+  TOKEN: {{ required "Token" | b64enc }}
+  QUOTED: {{ squote "it's" }}
+labels:{{ toYaml .Labels | nindent 2 }}`,
+			givenVars: map[string]interface{}{
+				"Name":   "my app",
+				"Token":  "secret",
+				"Labels": map[string]interface{}{"team": "games", "tier": "prd"},
+			},
+
+			wantError: false,
+			wantOutput: `env_variables:
+  NAME: "MY APP"
+  REGION: us-east1
+  TOKEN: c2VjcmV0
+  QUOTED: 'it''s'
+labels:
+  team: games
+  tier: prd`,
+		},
+		{
+			name:          "required var missing",
+			givenContents: `token: {{ required "Token" }}`,
+			givenVars:     map[string]interface{}{"Token": ""},
+
 			wantError: true,
 		},
 	}
@@ -248,3 +321,106 @@ func TestEncodedToken(t *testing.T) {
 	configFromEnv(&vargs, &workspace)
 	assert.Equal(t, nonEncodedToken, vargs.Token)
 }
+
+func TestSetupFileStaged(t *testing.T) {
+	workspace, err := ioutil.TempDir("", "drone-gae-workspace")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(workspace)
+	stage, err := ioutil.TempDir("", "drone-gae-stage")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(stage)
+
+	template := "runtime: go\nservice: {{ .Service }}\n"
+	err = ioutil.WriteFile(filepath.Join(workspace, "stg-app.yaml"), []byte(template), 0644)
+	if err != nil {
+		t.Fatalf("unable to write template: %s", err)
+	}
+
+	vargs := GAE{
+		AppFile:      "stg-app.yaml",
+		TemplateVars: map[string]interface{}{"Service": "api"},
+		stageDir:     stage,
+	}
+	assert.NoError(t, setupAppFile(workspace, vargs))
+
+	// rendered into the staging directory
+	assert.Equal(t, filepath.Join(stage, "app.yaml"), appFilePath(workspace, vargs))
+	got, err := ioutil.ReadFile(appFilePath(workspace, vargs))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "runtime: go\nservice: api\n", string(got))
+	}
+
+	// the workspace is untouched
+	got, err = ioutil.ReadFile(filepath.Join(workspace, "stg-app.yaml"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, template, string(got))
+	}
+	_, err = os.Stat(filepath.Join(workspace, "app.yaml"))
+	assert.True(t, os.IsNotExist(err))
+
+	// staged files are deployed from the staging directory
+	vargs.CronFile = "stg-cron.yaml"
+	assert.Equal(t, filepath.Join(stage, "cron.yaml"), deployable(workspace, vargs, "cron.yaml", vargs.CronFile))
+	assert.Equal(t, "./dispatch.yaml", deployable(workspace, vargs, "dispatch.yaml", vargs.DispatchFile))
+}
+
+func TestSetupTemplates(t *testing.T) {
+	workspace, err := ioutil.TempDir("", "drone-gae")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(workspace)
+
+	err = ioutil.WriteFile(filepath.Join(workspace, "gcloudignore.tmpl"), []byte("{{ .IGNORE }}\n"), 0644)
+	if err != nil {
+		t.Fatalf("unable to write template: %s", err)
+	}
+	err = ioutil.WriteFile(filepath.Join(workspace, "config.json.tmpl"), []byte(`{"host": {{ .HOST | quote }}}`), 0644)
+	if err != nil {
+		t.Fatalf("unable to write template: %s", err)
+	}
+
+	vargs := GAE{
+		Templates: []TemplateFile{
+			{Src: "gcloudignore.tmpl", Dest: ".gcloudignore"},
+			{Src: "config.json.tmpl", Dest: "config/config.json"},
+		},
+		TemplateVars: map[string]interface{}{"IGNORE": "node_modules/", "HOST": "example.com"},
+	}
+	assert.NoError(t, setupTemplates(workspace, vargs))
+
+	got, err := ioutil.ReadFile(filepath.Join(workspace, ".gcloudignore"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "node_modules/\n", string(got))
+	}
+	got, err = ioutil.ReadFile(filepath.Join(workspace, "config", "config.json"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, `{"host": "example.com"}`, string(got))
+	}
+
+	// yaml escaping leaves other files alone
+	vargs.TemplateEscape = "yaml"
+	assert.NoError(t, setupTemplates(workspace, vargs))
+	got, err = ioutil.ReadFile(filepath.Join(workspace, ".gcloudignore"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "node_modules/\n", string(got))
+	}
+	got, err = ioutil.ReadFile(filepath.Join(workspace, "config", "config.json"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, `{"host": "example.com"}`, string(got))
+	}
+	vargs.TemplateEscape = ""
+
+	vargs.Templates = []TemplateFile{{Src: "config.json.tmpl", Dest: "config.json.tmpl"}}
+	assert.Error(t, setupTemplates(workspace, vargs))
+
+	vargs.Templates = []TemplateFile{{Src: "config.json.tmpl", Dest: "../config.json"}}
+	assert.Error(t, setupTemplates(workspace, vargs))
+
+	vargs.Templates = []TemplateFile{{Src: "config.json.tmpl"}}
+	assert.Error(t, setupTemplates(workspace, vargs))
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"text/template"
+	"time"
+)
+
+// notifyEvents are the events webhooks can be sent for.
+var notifyEvents = []string{"start", "success", "failure", "rollback"}
+
+// defaultMessages are used for webhooks without a message template.
+var defaultMessages = map[string]string{
+	"start":    "Deploying {{ .Project }}{{ with .Service }}/{{ . }}{{ end }}{{ with .Version }} version {{ . }}{{ end }} from {{ .Commit }}",
+	"success":  "Deployed {{ .Project }}/{{ .Service }} version {{ .Version }} from {{ .Commit }}: {{ .URL }}",
+	"failure":  "Deploy of {{ .Project }}{{ with .Service }}/{{ . }}{{ end }}{{ with .Version }} version {{ . }}{{ end }} from {{ .Commit }} failed: {{ .Error }}",
+	"rollback": "Rolled back {{ .Project }}/{{ .Service }} after version {{ .Version }} failed its smoke tests",
+}
+
+// notifyRetryDelay is the wait before the first retry of a webhook, doubled
+// for every retry after that.
+var notifyRetryDelay = time.Second
+
+// Notify configures the webhooks sent as a deploy progresses.
+type Notify struct {
+	Webhooks []Webhook `json:"webhooks"`
+	// Retries is how often a failed webhook is retried. Defaults to 3.
+	Retries int `json:"retries"`
+	// Timeout is how long to wait for each webhook request. Defaults to 10s.
+	Timeout string `json:"timeout"`
+}
+
+// Webhook is a single notification target.
+type Webhook struct {
+	URL string `json:"url"`
+	// Format is "slack" to post {"text": MESSAGE} or "json" (default) to post
+	// the whole event.
+	Format string `json:"format"`
+	// Events limits the webhook to some of start, success, failure and
+	// rollback. Defaults to all of them.
+	Events []string `json:"events"`
+	// Message is a template for the message, executed with the NotifyEvent.
+	// Defaults to a message for each event.
+	Message string `json:"message"`
+}
+
+// NotifyEvent is what gets sent to webhooks, and what message templates are
+// executed with.
+type NotifyEvent struct {
+	Event       string `json:"event"`
+	Message     string `json:"message"`
+	Project     string `json:"project"`
+	Service     string `json:"service,omitempty"`
+	Version     string `json:"version,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Commit      string `json:"commit,omitempty"`
+	Branch      string `json:"branch,omitempty"`
+	Repo        string `json:"repo,omitempty"`
+	BuildNumber string `json:"build_number,omitempty"`
+	Author      string `json:"author,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// validateNotify fills in defaults and makes sure the webhooks are usable
+// before anything is deployed.
+func validateNotify(vargs *GAE) error {
+	n := &vargs.Notify
+	if len(n.Webhooks) == 0 {
+		return nil
+	}
+
+	if n.Retries <= 0 {
+		n.Retries = 3
+	}
+	if n.Timeout == "" {
+		n.Timeout = "10s"
+	}
+	if _, err := time.ParseDuration(n.Timeout); err != nil {
+		return fmt.Errorf("invalid param notify.timeout: %s", err)
+	}
+
+	for i, wh := range n.Webhooks {
+		if wh.URL == "" {
+			return fmt.Errorf("invalid param notify.webhooks[%d]: missing url", i)
+		}
+		switch wh.Format {
+		case "", "json", "slack":
+		default:
+			return fmt.Errorf("invalid param notify.webhooks[%d]: format must be json or slack", i)
+		}
+		for _, e := range wh.Events {
+			if !contains(notifyEvents, e) {
+				return fmt.Errorf("invalid param notify.webhooks[%d]: unknown event %q", i, e)
+			}
+		}
+		if wh.Message != "" {
+			if _, err := messageTemplate(wh.Message, vargs.TemplateVars); err != nil {
+				return fmt.Errorf("invalid param notify.webhooks[%d]: %s", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// notify sends event to all webhooks that want it. Failed notifications are
+// reported but never fail the deploy.
+func notify(vargs GAE, event string, res *Result, deployErr error) {
+	if len(vargs.Notify.Webhooks) == 0 {
+		return
+	}
+
+	meta := droneMetadata(os.Getenv)
+	ev := NotifyEvent{
+		Event:       event,
+		Project:     vargs.Project,
+		Service:     res.Service,
+		Version:     res.Version,
+		URL:         res.VersionURL,
+		Commit:      meta.SHA,
+		Branch:      meta.SourceBranch,
+		Repo:        meta.Repo,
+		BuildNumber: meta.BuildNumber,
+		Author:      meta.Author,
+	}
+	if ev.Service == "" {
+		ev.Service = vargs.Service
+	}
+	if deployErr != nil {
+		ev.Error = deployErr.Error()
+	}
+
+	timeout, _ := time.ParseDuration(vargs.Notify.Timeout)
+	client := &http.Client{Timeout: timeout}
+
+	for i, wh := range vargs.Notify.Webhooks {
+		if len(wh.Events) > 0 && !contains(wh.Events, event) {
+			continue
+		}
+		err := sendWebhook(client, wh, ev, vargs.Notify.Retries, vargs.TemplateVars)
+		if err != nil {
+			fmt.Printf("warning: %s notification to webhook %d failed: %s\n", event, i, err)
+		}
+	}
+}
+
+// sendWebhook renders the message and posts it, retrying failures.
+func sendWebhook(client *http.Client, wh Webhook, ev NotifyEvent, retries int, vars map[string]interface{}) error {
+	msg := wh.Message
+	if msg == "" {
+		msg = defaultMessages[ev.Event]
+	}
+	tmpl, err := messageTemplate(msg, vars)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, ev); err != nil {
+		return fmt.Errorf("error executing message template: %s", err)
+	}
+	ev.Message = out.String()
+
+	var body []byte
+	if wh.Format == "slack" {
+		body, err = json.Marshal(map[string]string{"text": ev.Message})
+	} else {
+		body, err = json.Marshal(ev)
+	}
+	if err != nil {
+		return err
+	}
+
+	delay := notifyRetryDelay
+	for attempt := 0; ; attempt++ {
+		err = postWebhook(client, wh.URL, body)
+		if err == nil || attempt >= retries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func postWebhook(client *http.Client, url string, body []byte) error {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// don't leak the webhook URL, it is usually a secret
+		if uerr, ok := err.(interface{ Unwrap() error }); ok {
+			err = uerr.Unwrap()
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func messageTemplate(msg string, vars map[string]interface{}) (*template.Template, error) {
+	tmpl, err := template.New("message").Funcs(templateFuncs(vars)).Parse(msg)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing message template: %s", err)
+	}
+	return tmpl, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateNotify(t *testing.T) {
+	vargs := GAE{Notify: Notify{Webhooks: []Webhook{{URL: "http://example.com"}}}}
+	require.NoError(t, validateNotify(&vargs))
+	assert.Equal(t, 3, vargs.Notify.Retries)
+	assert.Equal(t, "10s", vargs.Notify.Timeout)
+
+	tests := []struct {
+		notify  Notify
+		wantErr string
+	}{
+		{Notify{Webhooks: []Webhook{{URL: "http://example.com"}}, Timeout: "soon"}, "invalid param notify.timeout"},
+		{Notify{Webhooks: []Webhook{{}}}, "notify.webhooks[0]: missing url"},
+		{Notify{Webhooks: []Webhook{{URL: "http://example.com", Format: "teams"}}}, "format must be json or slack"},
+		{Notify{Webhooks: []Webhook{{URL: "http://example.com", Events: []string{"done"}}}}, `unknown event "done"`},
+		{Notify{Webhooks: []Webhook{{URL: "http://example.com", Message: "{{ .Version"}}}, "error parsing message template"},
+	}
+	for _, test := range tests {
+		vargs := GAE{Notify: test.notify}
+		err := validateNotify(&vargs)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), test.wantErr)
+	}
+}
+
+// webhookRecorder is a webhook endpoint that fails the first few requests.
+type webhookRecorder struct {
+	mu       sync.Mutex
+	failures int
+	bodies   []string
+}
+
+func (wr *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if wr.failures > 0 {
+		wr.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	wr.bodies = append(wr.bodies, string(body))
+}
+
+func TestNotify(t *testing.T) {
+	defer func(d time.Duration) { notifyRetryDelay = d }(notifyRetryDelay)
+	notifyRetryDelay = time.Millisecond
+
+	slack := &webhookRecorder{failures: 2}
+	slackSrv := httptest.NewServer(slack)
+	defer slackSrv.Close()
+	generic := &webhookRecorder{}
+	genericSrv := httptest.NewServer(generic)
+	defer genericSrv.Close()
+
+	vargs := GAE{
+		Project: "prj",
+		Notify: Notify{Webhooks: []Webhook{
+			{URL: slackSrv.URL, Format: "slack", Events: []string{"success"},
+				Message: "{{ .Version }} is live at {{ .URL }}"},
+			{URL: genericSrv.URL},
+		}},
+	}
+	require.NoError(t, validateNotify(&vargs))
+
+	res := &Result{Service: "api", Version: "v1", VersionURL: "https://v1-dot-api-dot-prj.appspot.com"}
+	notify(vargs, "start", res, nil)
+	notify(vargs, "success", res, nil)
+
+	assert.Equal(t, []string{`{"text":"v1 is live at https://v1-dot-api-dot-prj.appspot.com"}`}, slack.bodies)
+
+	require.Len(t, generic.bodies, 2)
+	var ev NotifyEvent
+	require.NoError(t, json.Unmarshal([]byte(generic.bodies[1]), &ev))
+	assert.Equal(t, "success", ev.Event)
+	assert.Equal(t, "prj", ev.Project)
+	assert.Equal(t, "api", ev.Service)
+	assert.Equal(t, "v1", ev.Version)
+	assert.Equal(t, "https://v1-dot-api-dot-prj.appspot.com", ev.URL)
+	assert.Contains(t, ev.Message, "Deployed prj/api version v1")
+
+	// failures carry the error
+	notify(vargs, "failure", res, errors.New("boom"))
+	require.Len(t, generic.bodies, 3)
+	require.NoError(t, json.Unmarshal([]byte(generic.bodies[2]), &ev))
+	assert.Equal(t, "boom", ev.Error)
+	assert.Contains(t, ev.Message, "failed: boom")
+}
+
+func TestSendWebhookGivesUp(t *testing.T) {
+	defer func(d time.Duration) { notifyRetryDelay = d }(notifyRetryDelay)
+	notifyRetryDelay = time.Millisecond
+
+	wr := &webhookRecorder{failures: 10}
+	srv := httptest.NewServer(wr)
+	defer srv.Close()
+
+	err := sendWebhook(http.DefaultClient, Webhook{URL: srv.URL}, NotifyEvent{Event: "start"}, 2, nil)
+	assert.EqualError(t, err, "unexpected status 503")
+	assert.Equal(t, 7, wr.failures)
+}
+
+func TestSendWebhookTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Timeout: 10 * time.Millisecond}
+	err := sendWebhook(client, Webhook{URL: srv.URL}, NotifyEvent{Event: "start"}, 0, nil)
+	assert.Error(t, err)
+}
+
+func TestNotifyStartAfterLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-gae-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	lockDir := filepath.Join(dir, "locks")
+	locks := &fileLock{dir: lockDir}
+
+	// record whether the deploy lock was held when each event arrived
+	var events []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev NotifyEvent
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&ev))
+		_, err := os.Stat(locks.path("prj/api"))
+		events = append(events, fmt.Sprintf("%s locked=%t", ev.Event, err == nil))
+	}))
+	defer srv.Close()
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "app.yaml"), []byte("runtime: go\n"), 0644))
+	vargs := GAE{
+		Action:         "deploy",
+		GCloudCmd:      writeFakeGcloud(t, dir, ""),
+		Project:        "prj",
+		Service:        "api",
+		Version:        "v1",
+		SkipValidation: true,
+		Lock:           lockDir,
+		LockTimeout:    "0s",
+		Notify:         Notify{Webhooks: []Webhook{{URL: srv.URL}}},
+	}
+	require.NoError(t, validateLock(&vargs))
+	require.NoError(t, validateNotify(&vargs))
+	runner := NewEnviron(dir, nil, &bytes.Buffer{}, &bytes.Buffer{})
+
+	// nothing is announced while another build holds the lock
+	ok, _, err := locks.tryLock("prj/api", "other#1")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Error(t, runAction(runner, dir, vargs, &Result{}))
+	assert.Empty(t, events)
+	assert.Empty(t, gcloudCalls(t, dir))
+
+	require.NoError(t, locks.unlock("prj/api"))
+	assert.NoError(t, runAction(runner, dir, vargs, &Result{}))
+	assert.Equal(t, []string{"start locked=true"}, events)
+}
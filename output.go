@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// DeployOutput holds the interesting bits of `gcloud app deploy` output.
+type DeployOutput struct {
+	Service     string `json:"service,omitempty"`
+	Version     string `json:"version,omitempty"`
+	VersionURL  string `json:"version_url,omitempty"`
+	TargetURL   string `json:"target_url,omitempty"`
+	BuildID     string `json:"build_id,omitempty"`
+	BuildLogURL string `json:"build_log_url,omitempty"`
+	Operation   string `json:"operation,omitempty"`
+}
+
+var (
+	reDeployedService = regexp.MustCompile(`Deployed service \[([^\]]+)\] to \[([^\]]+)\]`)
+	reTargetVersion   = regexp.MustCompile(`target version:\s+\[([^\]]+)\]`)
+	reTargetService   = regexp.MustCompile(`target service:\s+\[([^\]]+)\]`)
+	reBuildID         = regexp.MustCompile(`(?:Started cloud build|Cloud Build|build) \[([0-9a-f-]{36})\]`)
+	reBuildLogURL     = regexp.MustCompile(`https://console\.cloud\.google\.com/cloud-build/builds[^\s\]]*`)
+	reOperation       = regexp.MustCompile(`apps/[^/\s]+/operations/[0-9a-zA-Z-]+`)
+	reBuildIDFromURL  = regexp.MustCompile(`/builds(?:;region=[^/]+)?/([0-9a-f-]{36})`)
+)
+
+// parseDeployOutput pulls the deployed service and version, the Cloud Build
+// details and the operation name out of what `gcloud app deploy --format json`
+// wrote to stdout and stderr.
+func parseDeployOutput(stdout, stderr []byte) DeployOutput {
+	var out DeployOutput
+
+	// stdout is only JSON when the deploy succeeds
+	var result struct {
+		Versions []struct {
+			ID      string `json:"id"`
+			Service string `json:"service"`
+			Version struct {
+				VersionURL string `json:"versionUrl"`
+			} `json:"version"`
+		} `json:"versions"`
+	}
+	if err := json.Unmarshal(stdout, &result); err == nil && len(result.Versions) > 0 {
+		v := result.Versions[0]
+		out.Service = v.Service
+		out.Version = v.ID
+		out.VersionURL = v.Version.VersionURL
+	}
+
+	if m := reTargetService.FindSubmatch(stderr); m != nil && out.Service == "" {
+		out.Service = string(m[1])
+	}
+	if m := reTargetVersion.FindSubmatch(stderr); m != nil && out.Version == "" {
+		out.Version = string(m[1])
+	}
+	if m := reDeployedService.FindSubmatch(stderr); m != nil {
+		if out.Service == "" {
+			out.Service = string(m[1])
+		}
+		out.TargetURL = string(m[2])
+	}
+	if m := reBuildLogURL.Find(stderr); m != nil {
+		out.BuildLogURL = string(m)
+		if id := reBuildIDFromURL.FindSubmatch(m); id != nil {
+			out.BuildID = string(id[1])
+		}
+	}
+	if m := reBuildID.FindSubmatch(stderr); m != nil && out.BuildID == "" {
+		out.BuildID = string(m[1])
+	}
+	if m := reOperation.FindAll(stderr, -1); m != nil {
+		// the last operation mentioned is the one that finished (or failed)
+		out.Operation = string(m[len(m)-1])
+	}
+
+	return out
+}
+
+// log prints whatever was found as structured fields, so they don't have to
+// be dug out of the gcloud output.
+func (o DeployOutput) log() {
+	fields := []struct{ name, value string }{
+		{"service", o.Service},
+		{"version", o.Version},
+		{"version_url", o.VersionURL},
+		{"target_url", o.TargetURL},
+		{"build_id", o.BuildID},
+		{"build_log_url", o.BuildLogURL},
+		{"operation", o.Operation},
+	}
+	for _, f := range fields {
+		if f.value != "" {
+			fmt.Printf("deploy %s: %s\n", f.name, f.value)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDeployOutput(t *testing.T) {
+	tests := []struct {
+		name string
+
+		givenStdout string
+		givenStderr string
+
+		want DeployOutput
+	}{
+		{
+			name: "successful standard deploy",
+			givenStdout: `{
+  "configs": [],
+  "versions": [
+    {
+      "id": "20240102t030405",
+      "project": "my-project",
+      "service": "api",
+      "traffic_split": 0.0,
+      "version": {
+        "id": "20240102t030405",
+        "versionUrl": "https://20240102t030405-dot-api-dot-my-project.uc.r.appspot.com"
+      }
+    }
+  ]
+}`,
+			givenStderr: `Services to deploy:
+
+descriptor:                  [/drone/src/app.yaml]
+source:                      [/drone/src]
+target project:              [my-project]
+target service:              [api]
+target version:              [20240102t030405]
+target url:                  [https://api-dot-my-project.uc.r.appspot.com]
+
+Beginning deployment of service [api]...
+Updating service [api]...
+Deployed service [api] to [https://api-dot-my-project.uc.r.appspot.com]
+`,
+
+			want: DeployOutput{
+				Service:    "api",
+				Version:    "20240102t030405",
+				VersionURL: "https://20240102t030405-dot-api-dot-my-project.uc.r.appspot.com",
+				TargetURL:  "https://api-dot-my-project.uc.r.appspot.com",
+			},
+		},
+		{
+			name: "failed cloud build",
+			givenStderr: `target service:              [default]
+target version:              [v42]
+
+Beginning deployment of service [default]...
+Updating service [default] (this may take several minutes)...
+ERROR: (gcloud.app.deploy) Error Response: [9] Cloud build 0a1b2c3d-1111-2222-3333-444455556666 status: FAILURE
+An unexpected error occurred. Refer to build logs: https://console.cloud.google.com/cloud-build/builds;region=us-central1/0a1b2c3d-1111-2222-3333-444455556666?project=123456
+Full build logs: https://console.cloud.google.com/cloud-build/builds;region=us-central1/0a1b2c3d-1111-2222-3333-444455556666?project=123456
+`,
+
+			want: DeployOutput{
+				Service:     "default",
+				Version:     "v42",
+				BuildID:     "0a1b2c3d-1111-2222-3333-444455556666",
+				BuildLogURL: "https://console.cloud.google.com/cloud-build/builds;region=us-central1/0a1b2c3d-1111-2222-3333-444455556666?project=123456",
+			},
+		},
+		{
+			name: "flex deploy with operation",
+			givenStderr: `Started cloud build [0a1b2c3d-1111-2222-3333-444455556666].
+Updating service [api] (this may take several minutes)...
+ERROR: (gcloud.app.deploy) Operation [apps/my-project/operations/9f8e7d6c-aaaa-bbbb] timed out.
+`,
+
+			want: DeployOutput{
+				BuildID:   "0a1b2c3d-1111-2222-3333-444455556666",
+				Operation: "apps/my-project/operations/9f8e7d6c-aaaa-bbbb",
+			},
+		},
+		{
+			name: "nothing useful",
+
+			givenStdout: "not json",
+			givenStderr: "ERROR: (gcloud.app.deploy) something went wrong",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := parseDeployOutput([]byte(test.givenStdout), []byte(test.givenStderr))
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestHasFlag(t *testing.T) {
+	vargs := GAE{
+		AddlArgs:  map[string]string{"--format": "yaml"},
+		AddlFlags: []string{"--verbosity=debug", ""},
+	}
+	assert.True(t, hasFlag(vargs, "--format"))
+	assert.True(t, hasFlag(vargs, "--verbosity"))
+	assert.False(t, hasFlag(vargs, "--promote"))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// previewVersion names the preview version of a build: pr-NUMBER for pull
+// requests, preview-BRANCH otherwise. The name is sanitized like any other
+// version.
+func previewVersion(meta DroneMeta) (string, error) {
+	switch {
+	case meta.PullRequest != "":
+		return "pr-" + meta.PullRequest, nil
+	case meta.SourceBranch != "":
+		return "preview-" + meta.SourceBranch, nil
+	default:
+		return "", fmt.Errorf("unable to name preview version: no pull request or branch in the build metadata")
+	}
+}
+
+// setupPreview names the version for preview deploys and cleanups, makes sure
+// a preview is never promoted and turns the preview into a cleanup when the
+// pull request was closed.
+func setupPreview(vargs *GAE, meta DroneMeta) error {
+	if vargs.Preview && meta.Event == "pull_request" && (meta.BuildAction == "close" || meta.BuildAction == "closed") {
+		fmt.Printf("pull request %s was closed, cleaning up its preview\n", meta.PullRequest)
+		vargs.Action = "preview-cleanup"
+	}
+
+	if !vargs.Preview && vargs.Action != "preview-cleanup" {
+		return nil
+	}
+
+	if vargs.Version != "" {
+		return fmt.Errorf("param version can't be used with previews: use version_template to name them")
+	}
+	if vargs.VersionTemplate == "" {
+		v, err := previewVersion(meta)
+		if err != nil {
+			return err
+		}
+		vargs.Version = v
+	}
+
+	if vargs.Action == "deploy" || vargs.Action == "update" {
+		if hasFlag(*vargs, "--promote") {
+			return fmt.Errorf("preview versions can't be deployed with --promote")
+		}
+		if !hasFlag(*vargs, "--no-promote") {
+			vargs.AddlFlags = append(vargs.AddlFlags, "--no-promote")
+		}
+	}
+	return nil
+}
+
+// cleanupPreview deletes the preview version of the build. A version that
+// was promoted in the meantime is left alone.
+func cleanupPreview(runner *Environ, workspace string, vargs GAE) error {
+	service, err := resolveService(workspace, vargs)
+	if err != nil {
+		return fmt.Errorf("error: unable to determine service, not removing preview: %s\n", err)
+	}
+
+	versions, err := listVersions(runner, vargs, service)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		if v.ID != vargs.Version {
+			continue
+		}
+		if v.TrafficSplit > 0 {
+			return fmt.Errorf("error: preview version %q is serving %g of the traffic of service %q: not removing it\n",
+				v.ID, v.TrafficSplit, service)
+		}
+		return deleteVersions(runner, vargs, service, []string{v.ID})
+	}
+
+	log.Printf("preview version %q of service %q not found: nothing to clean up", vargs.Version, service)
+	return nil
+}
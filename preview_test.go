@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupPreview(t *testing.T) {
+	pr := DroneMeta{Event: "pull_request", PullRequest: "42", SourceBranch: "feature/thing"}
+	push := DroneMeta{Event: "push", SourceBranch: "feature/thing"}
+
+	tests := []struct {
+		name    string
+		vargs   GAE
+		meta    DroneMeta
+		want    GAE
+		wantErr string
+	}{
+		{
+			name:  "not a preview",
+			vargs: GAE{Action: "deploy"},
+			meta:  pr,
+			want:  GAE{Action: "deploy"},
+		},
+		{
+			name:  "pull request",
+			vargs: GAE{Action: "deploy", Preview: true},
+			meta:  pr,
+			want:  GAE{Action: "deploy", Preview: true, Version: "pr-42", AddlFlags: []string{"--no-promote"}},
+		},
+		{
+			name:  "branch",
+			vargs: GAE{Action: "deploy", Preview: true},
+			meta:  push,
+			want:  GAE{Action: "deploy", Preview: true, Version: "preview-feature/thing", AddlFlags: []string{"--no-promote"}},
+		},
+		{
+			name:  "no-promote already set",
+			vargs: GAE{Action: "deploy", Preview: true, AddlFlags: []string{"--no-promote"}},
+			meta:  pr,
+			want:  GAE{Action: "deploy", Preview: true, Version: "pr-42", AddlFlags: []string{"--no-promote"}},
+		},
+		{
+			name:  "version template",
+			vargs: GAE{Action: "deploy", Preview: true, VersionTemplate: "pr-{{ .PullRequest }}-{{ .ShortSHA }}"},
+			meta:  pr,
+			want: GAE{Action: "deploy", Preview: true, VersionTemplate: "pr-{{ .PullRequest }}-{{ .ShortSHA }}",
+				AddlFlags: []string{"--no-promote"}},
+		},
+		{
+			name:  "closed pull request",
+			vargs: GAE{Action: "deploy", Preview: true},
+			meta:  DroneMeta{Event: "pull_request", BuildAction: "close", PullRequest: "42"},
+			want:  GAE{Action: "preview-cleanup", Preview: true, Version: "pr-42"},
+		},
+		{
+			name:  "closed pull request, past tense",
+			vargs: GAE{Action: "deploy", Preview: true},
+			meta:  DroneMeta{Event: "pull_request", BuildAction: "closed", PullRequest: "42"},
+			want:  GAE{Action: "preview-cleanup", Preview: true, Version: "pr-42"},
+		},
+		{
+			name:  "cleanup action",
+			vargs: GAE{Action: "preview-cleanup"},
+			meta:  pr,
+			want:  GAE{Action: "preview-cleanup", Version: "pr-42"},
+		},
+		{
+			name:    "explicit version",
+			vargs:   GAE{Action: "deploy", Preview: true, Version: "v1"},
+			meta:    pr,
+			wantErr: "param version can't be used with previews",
+		},
+		{
+			name:    "promote",
+			vargs:   GAE{Action: "deploy", Preview: true, AddlFlags: []string{"--promote"}},
+			meta:    pr,
+			wantErr: "preview versions can't be deployed with --promote",
+		},
+		{
+			name:    "no metadata",
+			vargs:   GAE{Action: "deploy", Preview: true},
+			wantErr: "unable to name preview version",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := setupPreview(&test.vargs, test.meta)
+			if test.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.want, test.vargs)
+		})
+	}
+}
+
+func TestCleanupPreview(t *testing.T) {
+	tests := []struct {
+		name       string
+		versions   string
+		wantDelete bool
+		wantErr    bool
+	}{
+		{
+			name:       "deletes preview",
+			versions:   `[{"id": "v1", "service": "api", "traffic_split": 1}, {"id": "pr-42", "service": "api"}]`,
+			wantDelete: true,
+		},
+		{
+			name:     "already gone",
+			versions: `[{"id": "v1", "service": "api", "traffic_split": 1}]`,
+		},
+		{
+			name:     "promoted",
+			versions: `[{"id": "pr-42", "service": "api", "traffic_split": 0.5}]`,
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "drone-gae-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			gcloud := writeFakeGcloud(t, dir, `if [ "$3" = "list" ]; then echo '`+test.versions+`'; fi`)
+
+			vargs := GAE{GCloudCmd: gcloud, Project: "prj", Service: "api", Version: "pr-42"}
+			runner := NewEnviron(dir, nil, &bytes.Buffer{}, &bytes.Buffer{})
+
+			err = cleanupPreview(runner, dir, vargs)
+			if test.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			calls := strings.Join(gcloudCalls(t, dir), "\n")
+			deleted := strings.Contains(calls, "app versions delete --service api --project prj --quiet pr-42")
+			assert.Equal(t, test.wantDelete, deleted)
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// minSecretLen is the shortest value that gets masked. Masking shorter values
+// (true, 1, us) would make the logs unreadable without protecting anything.
+const minSecretLen = 4
+
+// maxRedactBuffer is how much output is held back waiting for the end of a
+// line before it is redacted and written anyway.
+const maxRedactBuffer = 64 * 1024
+
+// redactor masks secret values, including their multi-line, escaped and
+// base64 encoded forms. A nil redactor masks nothing.
+type redactor struct {
+	// variants of every secret, longest first
+	values []string
+}
+
+func newRedactor(secrets ...string) *redactor {
+	r := &redactor{}
+	r.add(secrets...)
+	return r
+}
+
+// add registers more secret values.
+func (r *redactor) add(secrets ...string) {
+	seen := map[string]bool{}
+	for _, v := range r.values {
+		seen[v] = true
+	}
+	addVariant := func(v string) {
+		if len(v) >= minSecretLen && !seen[v] {
+			seen[v] = true
+			r.values = append(r.values, v)
+		}
+	}
+
+	for _, s := range secrets {
+		addVariant(s)
+		// as it would appear in JSON or a quoted string
+		addVariant(strings.Trim(strconv.Quote(s), `"`))
+		// each line on its own, for output that's split up
+		if strings.Contains(s, "\n") {
+			for _, line := range strings.Split(s, "\n") {
+				addVariant(strings.TrimSpace(line))
+			}
+		}
+		// base64 encoded
+		if len(s) >= minSecretLen {
+			addVariant(base64.StdEncoding.EncodeToString([]byte(s)))
+			addVariant(base64.RawStdEncoding.EncodeToString([]byte(s)))
+			addVariant(base64.URLEncoding.EncodeToString([]byte(s)))
+			addVariant(base64.RawURLEncoding.EncodeToString([]byte(s)))
+		}
+	}
+
+	sort.SliceStable(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+}
+
+// redact replaces every secret in s.
+func (r *redactor) redact(s string) string {
+	if r == nil {
+		return s
+	}
+	for _, v := range r.values {
+		s = strings.Replace(s, v, "[redacted]", -1)
+	}
+	return s
+}
+
+// writer wraps w so everything written through it is redacted. Output is
+// redacted a line at a time, so Flush must be called when done.
+func (r *redactor) writer(w io.Writer) *redactWriter {
+	return &redactWriter{r: r, w: w}
+}
+
+type redactWriter struct {
+	r   *redactor
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func (rw *redactWriter) Write(p []byte) (int, error) {
+	if rw.r == nil || len(rw.r.values) == 0 {
+		return rw.w.Write(p)
+	}
+
+	rw.buf.Write(p)
+	i := bytes.LastIndexByte(rw.buf.Bytes(), '\n')
+	if i < 0 && rw.buf.Len() < maxRedactBuffer {
+		return len(p), nil
+	}
+	if i < 0 {
+		i = rw.buf.Len() - 1
+	}
+
+	chunk := rw.buf.Next(i + 1)
+	if _, err := io.WriteString(rw.w, rw.r.redact(string(chunk))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes out whatever is left of a partial line.
+func (rw *redactWriter) Flush() error {
+	if rw.buf.Len() == 0 {
+		return nil
+	}
+	_, err := io.WriteString(rw.w, rw.r.redact(rw.buf.String()))
+	rw.buf.Reset()
+	return err
+}
+
+// secretValues collects everything that should never show up in the logs:
+// vars not listed in public_vars, secrets from Secret Manager, ae_environment
+// values, addl_args listed in secret_args and the credentials.
+func secretValues(vargs GAE) []string {
+	var secrets []string
+
+	public := map[string]bool{}
+	for _, k := range vargs.PublicVars {
+		public[k] = true
+	}
+
+	// vars and ae_environment are how secrets get to the app, but they hold
+	// plain settings too. Masking those would only make the logs unreadable.
+	for k, v := range vargs.TemplateVars {
+		if public[k] {
+			continue
+		}
+		walkStrings(v, func(s string) string {
+			if !isPlainSetting(vargs, s) {
+				secrets = append(secrets, s)
+			}
+			return s
+		})
+	}
+
+	secrets = append(secrets, vargs.resolvedSecrets...)
+
+	for _, v := range vargs.AEEnv {
+		if !isPlainSetting(vargs, v) {
+			secrets = append(secrets, v)
+		}
+	}
+
+	for _, k := range vargs.SecretArgs {
+		if v, ok := vargs.AddlArgs[k]; ok {
+			secrets = append(secrets, v)
+		}
+	}
+
+	// webhook URLs usually carry their own credentials
+	for _, wh := range vargs.Notify.Webhooks {
+		secrets = append(secrets, wh.URL)
+	}
+
+	if vargs.Token != "" {
+		secrets = append(secrets, vargs.Token)
+		var key struct {
+			PrivateKey   string `json:"private_key"`
+			PrivateKeyID string `json:"private_key_id"`
+		}
+		if json.Unmarshal([]byte(vargs.Token), &key) == nil {
+			secrets = append(secrets, key.PrivateKey, key.PrivateKeyID)
+		}
+	}
+
+	return secrets
+}
+
+// isPlainSetting reports whether v is obviously not a secret: the project,
+// service or version being deployed, or a boolean.
+func isPlainSetting(vargs GAE, v string) bool {
+	switch strings.ToLower(v) {
+	case strings.ToLower(vargs.Project), strings.ToLower(vargs.Service), strings.ToLower(vargs.Version),
+		"true", "false", "yes", "no", "on", "off":
+		return true
+	}
+	return false
+}
@@ -1,81 +1,228 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"os"
-	"path/filepath"
+	"path"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
-func removeOldVersions(runner *Environ, workspace string, vargs GAE) error {
-	// read in the app.yaml file to grab the module/service mame we just deployed
-	appLoc := filepath.Join(workspace, vargs.Dir, "app.yaml")
-	appFile, err := os.Open(appLoc)
+func removeOldVersions(runner *Environ, workspace string, vargs GAE, res *Result) error {
+	// figure out which service we just deployed. If we can't tell for sure,
+	// bail out rather than risk deleting versions of some other service.
+	service, err := resolveService(workspace, vargs)
 	if err != nil {
-		return fmt.Errorf("error: %s\n", err)
-	}
-	defer appFile.Close()
-	var appStruct struct {
-		Service string `yaml:"service"`
-		Module  string `yaml:"module"`
+		return fmt.Errorf("error: unable to determine service, not removing old versions: %s\n", err)
 	}
-	err = yaml.NewDecoder(appFile).Decode(&appStruct)
+
+	// look up existing versions for given service ordered by create time desc
+	results, err := listVersions(runner, vargs, service)
 	if err != nil {
-		return fmt.Errorf("error: %s\n", err)
+		return err
 	}
 
-	service := appStruct.Service
-	if service == "" {
-		service = appStruct.Module
+	plan := selectOldVersions(results, vargs)
+
+	if len(plan.protected) > 0 {
+		log.Printf("keeping %d protected versions of service %q: %s", len(plan.protected), service, plan.protected)
 	}
 
-	// look up existing versions for given service ordered by create time desc
-	var versionJSON bytes.Buffer
-	sout := runner.stdout
-	runner.stdout = &versionJSON
-	err = runner.Run(vargs.GCloudCmd, "app", "versions", "list",
+	if len(plan.unstoppable) > 0 {
+		log.Printf("not stopping %d automatically scaled versions of service %q, "+
+			"only versions with basic or manual scaling can be stopped: %s",
+			len(plan.unstoppable), service, plan.unstoppable)
+	}
+
+	// delete first: a failed stop must not keep old versions around
+	if len(plan.toDelete) > 0 {
+		err = deleteVersions(runner, vargs, service, plan.toDelete)
+		if err != nil {
+			return err
+		}
+		res.DeletedVersions = plan.toDelete
+	}
+
+	// the deploy already succeeded, so versions that keep running only cost money
+	if len(plan.toStop) > 0 {
+		log.Printf("stopping %d versions of service %q: %s", len(plan.toStop), service, plan.toStop)
+
+		args := []string{"app", "versions", "stop",
+			"--service", service, "--project", vargs.Project, "--quiet"}
+		args = append(args, plan.toStop...)
+		err = runner.Run(vargs.GCloudCmd, args...)
+		if err != nil {
+			fmt.Printf("warning: unable to stop old versions: %s\n", err)
+		} else {
+			res.StoppedVersions = plan.toStop
+		}
+	}
+
+	return nil
+}
+
+// listVersions looks up the versions of a service, newest first.
+func listVersions(runner *Environ, vargs GAE, service string) ([]versionInfo, error) {
+	versionJSON, err := runner.Output(vargs.GCloudCmd, "app", "versions", "list",
 		"--service", service, "--project", vargs.Project,
 		"--format", "json", "--sort-by", "~version.createTime", "--quiet")
 	if err != nil {
-		return fmt.Errorf("error: %s\n", err)
+		return nil, fmt.Errorf("error: %s\n", err)
 	}
 
-	var results []struct {
-		ID           string  `json:"id"`
-		TrafficSplit float64 `json:"traffic_split"`
+	var results []versionInfo
+	err = json.Unmarshal(versionJSON, &results)
+	if err != nil {
+		return nil, err
 	}
-	err = json.NewDecoder(&versionJSON).Decode(&results)
+
+	// never touch a version that gcloud says belongs to another service
+	for _, res := range results {
+		if res.Service != service {
+			return nil, fmt.Errorf("error: version %q belongs to service %q, expected %q: not removing versions\n",
+				res.ID, res.Service, service)
+		}
+	}
+	return results, nil
+}
+
+// deleteVersions deletes the given versions of a service.
+func deleteVersions(runner *Environ, vargs GAE, service string, ids []string) error {
+	log.Printf("deleting %d versions of service %q: %s", len(ids), service, ids)
+
+	args := []string{"app", "versions", "delete",
+		"--service", service, "--project", vargs.Project, "--quiet"}
+	args = append(args, ids...)
+	err := runner.Run(vargs.GCloudCmd, args...)
 	if err != nil {
-		return err
+		return fmt.Errorf("error: %s\n", err)
+	}
+	return nil
+}
+
+// versionInfo is a single entry of `gcloud app versions list --format json`.
+type versionInfo struct {
+	ID           string  `json:"id"`
+	Service      string  `json:"service"`
+	TrafficSplit float64 `json:"traffic_split"`
+	Version      struct {
+		ServingStatus string          `json:"servingStatus"`
+		Env           string          `json:"env"`
+		BasicScaling  json.RawMessage `json:"basicScaling"`
+		ManualScaling json.RawMessage `json:"manualScaling"`
+	} `json:"version"`
+}
+
+// stoppable reports whether App Engine allows stopping the version: any
+// flexible version, but only standard versions with basic or manual scaling.
+func (v versionInfo) stoppable() bool {
+	if v.Version.Env == "flex" || v.Version.Env == "flexible" {
+		return true
+	}
+	return len(v.Version.BasicScaling) > 0 || len(v.Version.ManualScaling) > 0
+}
+
+// cleanupPlan holds what selectOldVersions decided to do with old versions.
+type cleanupPlan struct {
+	toStop      []string
+	toDelete    []string
+	protected   []string
+	unstoppable []string
+}
+
+// selectOldVersions walks the versions, newest first, and decides which old
+// versions to stop (beyond MaxRunningVersions) and which to delete (beyond
+// MaxVersions). Old versions that are protected, or that would need stopping
+// but can't be, are left alone and returned separately so they can be
+// reported.
+func selectOldVersions(results []versionInfo, vargs GAE) cleanupPlan {
+	// there's no sense in keeping more versions running than we keep at all
+	keepRunning := vargs.MaxRunningVersions
+	if vargs.MaxVersions > 0 && (keepRunning <= 0 || keepRunning > vargs.MaxVersions) {
+		keepRunning = vargs.MaxVersions
 	}
 
-	var toDelete []string
+	var plan cleanupPlan
 	for i, res := range results {
 		// keep newer versions, the newly deployed version or anything that has traffic
-		if i < vargs.MaxVersions || res.ID == vargs.Version || res.TrafficSplit > 0 {
+		if i < keepRunning || res.ID == vargs.Version || res.TrafficSplit > 0 {
 			continue
 		}
-		toDelete = append(toDelete, res.ID)
+		if isProtectedVersion(res.ID, vargs.ProtectedVersions) {
+			plan.protected = append(plan.protected, res.ID)
+			continue
+		}
+		switch {
+		case vargs.MaxVersions > 0 && i >= vargs.MaxVersions:
+			plan.toDelete = append(plan.toDelete, res.ID)
+		case vargs.MaxRunningVersions > 0 && res.Version.ServingStatus == "SERVING":
+			if res.stoppable() {
+				plan.toStop = append(plan.toStop, res.ID)
+			} else {
+				plan.unstoppable = append(plan.unstoppable, res.ID)
+			}
+		}
 	}
+	return plan
+}
 
-	if len(toDelete) == 0 {
-		return nil
+// isProtectedVersion reports whether the version matches any of the given
+// names or shell patterns (ex: hotfix-*).
+func isProtectedVersion(id string, patterns []string) bool {
+	for _, p := range patterns {
+		if p == "" {
+			continue
+		}
+		if p == id {
+			return true
+		}
+		if ok, err := path.Match(p, id); err == nil && ok {
+			return true
+		}
 	}
+	return false
+}
 
-	log.Printf("deleting %d versions: %s", len(toDelete), toDelete)
+// resolveService determines the service a deployment targeted. An explicit
+// `service` setting always wins, otherwise the service is read from the
+// rendered app.yaml. An app.yaml without a service (or module) entry
+// deploys to the "default" service.
+func resolveService(workspace string, vargs GAE) (string, error) {
+	if vargs.Service != "" {
+		return vargs.Service, nil
+	}
 
-	runner.stdout = sout
-	args := []string{"app", "versions", "delete",
-		"--service", service, "--project", vargs.Project, "--quiet"}
-	args = append(args, toDelete...)
-	err = runner.Run(vargs.GCloudCmd, args...)
+	// setupAppFile has already rendered any custom app_file, so read the
+	// rendered copy: that is the file gcloud deployed.
+	appLoc := appFilePath(workspace, vargs)
+	blob, err := ioutil.ReadFile(appLoc)
 	if err != nil {
-		return fmt.Errorf("error: %s\n", err)
+		return "", err
 	}
 
-	return nil
+	// an unrendered template may still parse as YAML, but it can't be trusted
+	if strings.Contains(string(blob), "{{") {
+		return "", fmt.Errorf("%s contains unrendered template directives", appLoc)
+	}
+
+	var appStruct struct {
+		Service string `yaml:"service"`
+		Module  string `yaml:"module"`
+	}
+	err = yaml.Unmarshal(blob, &appStruct)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse %s: %s", appLoc, err)
+	}
+
+	service := appStruct.Service
+	if service == "" {
+		service = appStruct.Module
+	}
+	if service == "" {
+		service = "default"
+	}
+	return service, nil
 }
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveService(t *testing.T) {
+	tests := []struct {
+		name string
+
+		givenService string
+		givenAppYAML string
+
+		wantService string
+		wantError   bool
+	}{
+		{
+			name:         "explicit service wins",
+			givenService: "api",
+			givenAppYAML: "service: frontend\n",
+
+			wantService: "api",
+		},
+		{
+			name:         "service from app.yaml",
+			givenAppYAML: "runtime: go\nservice: frontend\n",
+
+			wantService: "frontend",
+		},
+		{
+			name:         "module from app.yaml",
+			givenAppYAML: "runtime: go\nmodule: legacy\n",
+
+			wantService: "legacy",
+		},
+		{
+			name:         "no service means default",
+			givenAppYAML: "runtime: go\n",
+
+			wantService: "default",
+		},
+		{
+			name:         "unrendered template",
+			givenAppYAML: "runtime: go\nservice: \"{{ .Service }}\"\n",
+
+			wantError: true,
+		},
+		{
+			name:         "invalid yaml",
+			givenAppYAML: "runtime: go\n  service: [\n",
+
+			wantError: true,
+		},
+		{
+			name: "missing app.yaml",
+
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "drone-gae")
+			if err != nil {
+				t.Fatalf("unable to create temp dir: %s", err)
+			}
+			defer os.RemoveAll(dir)
+
+			if test.givenAppYAML != "" {
+				err = ioutil.WriteFile(filepath.Join(dir, "app.yaml"), []byte(test.givenAppYAML), 0644)
+				if err != nil {
+					t.Fatalf("unable to write app.yaml: %s", err)
+				}
+			}
+
+			got, err := resolveService(dir, GAE{Service: test.givenService})
+			if test.wantError {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.wantService, got)
+			}
+		})
+	}
+}
+
+func TestSelectOldVersions(t *testing.T) {
+	results := []versionInfo{
+		{ID: "v6", Service: "api"},
+		{ID: "v5", Service: "api", TrafficSplit: 1},
+		{ID: "v4", Service: "api"},
+		{ID: "hotfix-3", Service: "api"},
+		{ID: "v2", Service: "api"},
+		{ID: "v1", Service: "api"},
+	}
+	for i := range results {
+		results[i].Version.ServingStatus = "SERVING"
+		results[i].Version.ManualScaling = json.RawMessage(`{"instances": 1}`)
+	}
+	results[4].Version.ServingStatus = "STOPPED"
+
+	plan := selectOldVersions(results, GAE{MaxVersions: 2})
+	assert.Equal(t, []string{"v4", "hotfix-3", "v2", "v1"}, plan.toDelete)
+	assert.Empty(t, plan.toStop)
+	assert.Empty(t, plan.protected)
+
+	plan = selectOldVersions(results, GAE{
+		MaxVersions:       2,
+		Version:           "v4",
+		ProtectedVersions: []string{"hotfix-*", "v1", ""},
+	})
+	assert.Equal(t, []string{"v2"}, plan.toDelete)
+	assert.Equal(t, []string{"hotfix-3", "v1"}, plan.protected)
+
+	// stop beyond 1, delete beyond 5. v2 is already stopped.
+	plan = selectOldVersions(results, GAE{MaxVersions: 5, MaxRunningVersions: 1})
+	assert.Equal(t, []string{"v4", "hotfix-3"}, plan.toStop)
+	assert.Equal(t, []string{"v1"}, plan.toDelete)
+
+	// stop only
+	plan = selectOldVersions(results, GAE{MaxRunningVersions: 3})
+	assert.Equal(t, []string{"hotfix-3", "v1"}, plan.toStop)
+	assert.Empty(t, plan.toDelete)
+
+	// automatically scaled standard versions can't be stopped
+	results[3].Version.ManualScaling = nil
+	plan = selectOldVersions(results, GAE{MaxRunningVersions: 3})
+	assert.Equal(t, []string{"v1"}, plan.toStop)
+	assert.Equal(t, []string{"hotfix-3"}, plan.unstoppable)
+	results[3].Version.Env = "flexible"
+	plan = selectOldVersions(results, GAE{MaxRunningVersions: 3})
+	assert.Equal(t, []string{"hotfix-3", "v1"}, plan.toStop)
+
+	// running count can't exceed the total count
+	plan = selectOldVersions(results, GAE{MaxVersions: 2, MaxRunningVersions: 4})
+	assert.Empty(t, plan.toStop)
+	assert.Equal(t, []string{"v4", "hotfix-3", "v2", "v1"}, plan.toDelete)
+}
+
+func TestRemoveOldVersions(t *testing.T) {
+	tests := []struct {
+		name       string
+		service    string
+		appYAML    string
+		versions   string
+		wantErr    string
+		wantDelete string
+		wantStop   string
+
+		maxVersions int
+		maxRunning  int
+	}{
+		{
+			name:       "deletes old versions",
+			service:    "api",
+			versions:   `[{"id": "v3", "service": "api"}, {"id": "v2", "service": "api"}, {"id": "v1", "service": "api"}]`,
+			wantDelete: "app versions delete --service api --project prj --quiet v2 v1",
+		},
+		{
+			name:    "stop failure after deletes",
+			service: "api",
+			versions: `[{"id": "v3", "service": "api"}, ` +
+				`{"id": "v2", "service": "api", "version": {"servingStatus": "SERVING", "manualScaling": {"instances": 1}}}, ` +
+				`{"id": "v1", "service": "api"}]`,
+			maxRunning:  1,
+			maxVersions: 2,
+			wantDelete:  "app versions delete --service api --project prj --quiet v1",
+			wantStop:    "app versions stop --service api --project prj --quiet v2",
+		},
+		{
+			name:     "versions of another service",
+			service:  "api",
+			versions: `[{"id": "v3", "service": "api"}, {"id": "v2", "service": "web"}, {"id": "v1", "service": "web"}]`,
+			wantErr:  `version "v2" belongs to service "web", expected "api"`,
+		},
+		{
+			name:     "service undetermined",
+			appYAML:  "runtime: go\nservice: {{ .SERVICE }}\n",
+			versions: `[{"id": "v3", "service": "api"}, {"id": "v2", "service": "api"}]`,
+			wantErr:  "unable to determine service, not removing old versions",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "drone-gae-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			if test.appYAML != "" {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "app.yaml"), []byte(test.appYAML), 0644))
+			}
+
+			if test.maxVersions == 0 {
+				test.maxVersions = 1
+			}
+			vargs := GAE{
+				GCloudCmd: writeFakeGcloud(t, dir, `if [ "$3" = "list" ]; then echo '`+test.versions+`'; fi
+if [ "$3" = "stop" ]; then exit 1; fi`),
+				Project:            "prj",
+				Service:            test.service,
+				Version:            "v3",
+				MaxVersions:        test.maxVersions,
+				MaxRunningVersions: test.maxRunning,
+			}
+			runner := NewEnviron(dir, nil, &bytes.Buffer{}, &bytes.Buffer{})
+			res := &Result{}
+
+			err = removeOldVersions(runner, dir, vargs, res)
+			if test.wantErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			var deletes, stops []string
+			for _, call := range gcloudCalls(t, dir) {
+				if strings.HasPrefix(call, "app versions delete") {
+					deletes = append(deletes, call)
+				}
+				if strings.HasPrefix(call, "app versions stop") {
+					stops = append(stops, call)
+				}
+			}
+			// the fake gcloud fails every stop, which must not fail the step
+			if test.wantStop != "" {
+				assert.Equal(t, []string{test.wantStop}, stops)
+				assert.Empty(t, res.StoppedVersions)
+			}
+			if test.wantDelete == "" {
+				assert.Empty(t, deletes)
+				assert.Empty(t, res.DeletedVersions)
+			} else {
+				assert.Equal(t, []string{test.wantDelete}, deletes)
+			}
+		})
+	}
+}
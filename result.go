@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Result describes what the plugin did. It is written to ResultFile and
+// ResultEnvFile so later pipeline steps don't need to re-derive any of it.
+type Result struct {
+	Success          bool            `json:"success"`
+	Error            string          `json:"error,omitempty"`
+	Action           string          `json:"action"`
+	Project          string          `json:"project"`
+	Service          string          `json:"service,omitempty"`
+	Version          string          `json:"version,omitempty"`
+	VersionURL       string          `json:"version_url,omitempty"`
+	PreviousVersions []string        `json:"previous_versions,omitempty"`
+	StoppedVersions  []string        `json:"stopped_versions,omitempty"`
+	DeletedVersions  []string        `json:"deleted_versions,omitempty"`
+	RolledBack       bool            `json:"rolled_back,omitempty"`
+	Deploy           *DeployOutput   `json:"deploy,omitempty"`
+	Commands         []CommandTiming `json:"commands"`
+}
+
+// CommandTiming records a single command run by the plugin.
+type CommandTiming struct {
+	// Command is the command line, with any secrets redacted.
+	Command string  `json:"command"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// setService fills in the deployed service and the version URL, if the
+// service can be determined.
+func (r *Result) setService(workspace string, vargs GAE) {
+	service, err := resolveService(workspace, vargs)
+	if err != nil {
+		return
+	}
+	r.Service = service
+	if r.Version != "" {
+		r.VersionURL = versionURL(vargs.Project, service, r.Version)
+	}
+}
+
+// envVars returns the result as GAE_* environment variables.
+func (r *Result) envVars() map[string]string {
+	vars := map[string]string{
+		"GAE_SUCCESS":           strconv.FormatBool(r.Success),
+		"GAE_ACTION":            r.Action,
+		"GAE_PROJECT":           r.Project,
+		"GAE_SERVICE":           r.Service,
+		"GAE_VERSION":           r.Version,
+		"GAE_VERSION_URL":       r.VersionURL,
+		"GAE_PREVIOUS_VERSIONS": strings.Join(r.PreviousVersions, ","),
+		"GAE_STOPPED_VERSIONS":  strings.Join(r.StoppedVersions, ","),
+		"GAE_DELETED_VERSIONS":  strings.Join(r.DeletedVersions, ","),
+	}
+	if r.Deploy != nil {
+		vars["GAE_BUILD_ID"] = r.Deploy.BuildID
+		vars["GAE_BUILD_LOG_URL"] = r.Deploy.BuildLogURL
+		vars["GAE_OPERATION"] = r.Deploy.Operation
+	}
+	return vars
+}
+
+// writeResult writes the result files requested in vargs, if any. runErr is
+// the outcome of the action.
+func writeResult(workspace string, vargs GAE, res *Result, runErr error) error {
+	if vargs.ResultFile == "" && vargs.ResultEnvFile == "" {
+		return nil
+	}
+
+	res.Action = vargs.Action
+	res.Success = runErr == nil
+	if runErr != nil {
+		res.Error = strings.TrimSpace(runErr.Error())
+	}
+
+	if vargs.ResultFile != "" {
+		blob, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return fmt.Errorf("error encoding result: %s\n", err)
+		}
+		err = ioutil.WriteFile(filepath.Join(workspace, vargs.ResultFile), append(blob, '\n'), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing result file: %s\n", err)
+		}
+	}
+
+	if vargs.ResultEnvFile != "" {
+		vars := res.envVars()
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var b strings.Builder
+		for _, k := range keys {
+			fmt.Fprintf(&b, "%s=%s\n", k, shellQuote(vars[k]))
+		}
+		err := ioutil.WriteFile(filepath.Join(workspace, vargs.ResultEnvFile), []byte(b.String()), 0644)
+		if err != nil {
+			return fmt.Errorf("error writing result env file: %s\n", err)
+		}
+	}
+
+	return nil
+}
+
+// shellQuote single-quotes s so sourcing the env file yields s unchanged:
+// nothing inside single quotes is expanded, so only quotes need escaping.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "drone-gae")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	vargs := GAE{
+		Action:        "deploy",
+		Project:       "my-project",
+		Service:       "api",
+		ResultFile:    "gae.json",
+		ResultEnvFile: "gae.env",
+	}
+	res := &Result{Project: vargs.Project, Version: "v2"}
+	res.setService(dir, vargs)
+	res.PreviousVersions = []string{"v1"}
+	res.DeletedVersions = []string{"v0", "old"}
+	res.Commands = []CommandTiming{{Command: "gcloud app deploy", Seconds: 1.5}}
+
+	assert.NoError(t, writeResult(dir, vargs, res, nil))
+
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "gae.json"))
+	if err != nil {
+		t.Fatalf("unable to read result file: %s", err)
+	}
+	var got Result
+	if assert.NoError(t, json.Unmarshal(blob, &got)) {
+		assert.True(t, got.Success)
+		assert.Equal(t, "deploy", got.Action)
+		assert.Equal(t, "api", got.Service)
+		assert.Equal(t, "https://v2-dot-api-dot-my-project.appspot.com", got.VersionURL)
+		assert.Equal(t, []string{"v1"}, got.PreviousVersions)
+		assert.Equal(t, []string{"v0", "old"}, got.DeletedVersions)
+		assert.Len(t, got.Commands, 1)
+	}
+
+	blob, err = ioutil.ReadFile(filepath.Join(dir, "gae.env"))
+	if err != nil {
+		t.Fatalf("unable to read result env file: %s", err)
+	}
+	assert.Contains(t, string(blob), "GAE_VERSION='v2'\n")
+	assert.Contains(t, string(blob), "GAE_DELETED_VERSIONS='v0,old'\n")
+	assert.Contains(t, string(blob), "GAE_SUCCESS='true'\n")
+
+	// failures are recorded too
+	assert.NoError(t, writeResult(dir, vargs, res, errors.New("error: exit status 1\n")))
+	blob, _ = ioutil.ReadFile(filepath.Join(dir, "gae.json"))
+	got = Result{}
+	if assert.NoError(t, json.Unmarshal(blob, &got)) {
+		assert.False(t, got.Success)
+		assert.Equal(t, "error: exit status 1", got.Error)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "''", shellQuote(""))
+	assert.Equal(t, "'v2'", shellQuote("v2"))
+	assert.Equal(t, "'$HOME `ls` \"x\"'", shellQuote("$HOME `ls` \"x\""))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+
+	// the quoted value survives sourcing unchanged
+	value := "error: $PATH `id` \\n it's \"done\""
+	out, err := exec.Command("sh", "-c", "X="+shellQuote(value)+"; printf %s \"$X\"").Output()
+	if assert.NoError(t, err) {
+		assert.Equal(t, value, string(out))
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// yamlKind is the kind of value an app.yaml key expects.
+type yamlKind int
+
+const (
+	kindScalar yamlKind = iota // string, number or bool
+	kindString
+	kindBool
+	kindNumber
+	kindMap
+	kindList
+	kindListOrString
+)
+
+func (k yamlKind) String() string {
+	switch k {
+	case kindString:
+		return "a string"
+	case kindBool:
+		return "a boolean"
+	case kindNumber:
+		return "a number"
+	case kindMap:
+		return "a mapping"
+	case kindList:
+		return "a list"
+	case kindListOrString:
+		return "a list or a string"
+	default:
+		return "a scalar"
+	}
+}
+
+// appEnv is the App Engine environment a key is valid in.
+type appEnv int
+
+const (
+	envBoth appEnv = iota
+	envStandard
+	envFlex
+)
+
+type appKey struct {
+	kind yamlKind
+	env  appEnv
+	// keys, if set, lists the keys allowed in a mapping (or in each mapping
+	// of a list).
+	keys map[string]appKey
+}
+
+// appYAMLSchema is a built-in description of the App Engine app.yaml
+// reference for the standard and flexible environments.
+var appYAMLSchema = map[string]appKey{
+	"runtime":                   {kind: kindString},
+	"env":                       {kind: kindString},
+	"service":                   {kind: kindScalar},
+	"module":                    {kind: kindScalar},
+	"entrypoint":                {kind: kindString},
+	"service_account":           {kind: kindString},
+	"env_variables":             {kind: kindMap},
+	"build_env_variables":       {kind: kindMap},
+	"beta_settings":             {kind: kindMap},
+	"inbound_services":          {kind: kindList},
+	"includes":                  {kind: kindList},
+	"skip_files":                {kind: kindListOrString},
+	"nobuild_files":             {kind: kindListOrString},
+	"runtime_channel":           {kind: kindString},
+	"default_expiration":        {kind: kindString, env: envStandard},
+	"instance_class":            {kind: kindString, env: envStandard},
+	"app_engine_apis":           {kind: kindBool, env: envStandard},
+	"threadsafe":                {kind: kindBool, env: envStandard},
+	"api_version":               {kind: kindScalar, env: envStandard},
+	"main":                      {kind: kindString, env: envStandard},
+	"libraries":                 {kind: kindList, env: envStandard},
+	"builtins":                  {kind: kindList, env: envStandard},
+	"error_handlers":            {kind: kindList, env: envStandard},
+	"derived_file_type":         {kind: kindList, env: envStandard},
+	"vpc_access_connector":      {kind: kindMap, env: envStandard},
+	"runtime_config":            {kind: kindMap, env: envFlex},
+	"flexible_runtime_settings": {kind: kindMap, env: envFlex},
+	"endpoints_api_service":     {kind: kindMap, env: envFlex},
+	"liveness_check":            {kind: kindMap, env: envFlex},
+	"readiness_check":           {kind: kindMap, env: envFlex},
+	"health_check":              {kind: kindMap, env: envFlex},
+	"vm":                        {kind: kindBool, env: envFlex},
+	"handlers": {kind: kindList, keys: map[string]appKey{
+		"url":                         {kind: kindString},
+		"script":                      {kind: kindString},
+		"static_files":                {kind: kindString},
+		"static_dir":                  {kind: kindString},
+		"upload":                      {kind: kindString},
+		"mime_type":                   {kind: kindString},
+		"expiration":                  {kind: kindString},
+		"http_headers":                {kind: kindMap},
+		"login":                       {kind: kindString},
+		"auth_fail_action":            {kind: kindString},
+		"secure":                      {kind: kindString},
+		"redirect_http_response_code": {kind: kindScalar},
+		"application_readable":        {kind: kindBool},
+		"require_matching_file":       {kind: kindBool},
+		"position":                    {kind: kindString},
+	}},
+	"automatic_scaling": {kind: kindMap, keys: map[string]appKey{
+		"target_cpu_utilization":        {kind: kindNumber, env: envStandard},
+		"target_throughput_utilization": {kind: kindNumber, env: envStandard},
+		"max_instances":                 {kind: kindNumber, env: envStandard},
+		"min_instances":                 {kind: kindNumber, env: envStandard},
+		"max_idle_instances":            {kind: kindScalar, env: envStandard},
+		"min_idle_instances":            {kind: kindScalar, env: envStandard},
+		"max_pending_latency":           {kind: kindString, env: envStandard},
+		"min_pending_latency":           {kind: kindString, env: envStandard},
+		"max_concurrent_requests":       {kind: kindNumber, env: envStandard},
+		"min_num_instances":             {kind: kindNumber, env: envFlex},
+		"max_num_instances":             {kind: kindNumber, env: envFlex},
+		"cool_down_period_sec":          {kind: kindNumber, env: envFlex},
+		"cpu_utilization":               {kind: kindMap, env: envFlex},
+		"target_concurrent_requests":    {kind: kindNumber, env: envFlex},
+		"standard_scheduler_settings": {kind: kindMap, env: envStandard, keys: map[string]appKey{
+			"target_cpu_utilization":        {kind: kindNumber},
+			"target_throughput_utilization": {kind: kindNumber},
+			"min_instances":                 {kind: kindNumber},
+			"max_instances":                 {kind: kindNumber},
+		}},
+	}},
+	"manual_scaling": {kind: kindMap, keys: map[string]appKey{
+		"instances": {kind: kindNumber},
+	}},
+	"basic_scaling": {kind: kindMap, env: envStandard, keys: map[string]appKey{
+		"max_instances": {kind: kindNumber},
+		"idle_timeout":  {kind: kindString},
+	}},
+	"resources": {kind: kindMap, env: envFlex, keys: map[string]appKey{
+		"cpu":          {kind: kindNumber},
+		"memory_gb":    {kind: kindNumber},
+		"disk_size_gb": {kind: kindNumber},
+		"volumes":      {kind: kindList},
+	}},
+	"network": {kind: kindMap, env: envFlex, keys: map[string]appKey{
+		"name":             {kind: kindString},
+		"subnetwork_name":  {kind: kindString},
+		"instance_tag":     {kind: kindString},
+		"forwarded_ports":  {kind: kindList},
+		"session_affinity": {kind: kindBool},
+		"instance_ip_mode": {kind: kindString},
+	}},
+}
+
+// appYAMLRejected are keys gcloud refuses to deploy with.
+var appYAMLRejected = map[string]string{
+	"application": "set the project with the `project` setting instead",
+	"version":     "set the version with the `version` setting instead",
+}
+
+// appYAMLReport collects what validateAppYAML found. Problems fail the
+// deploy. Unknown keys are only warnings, since App Engine may have added
+// keys the schema doesn't know about yet.
+type appYAMLReport struct {
+	problems []string
+	warnings []string
+}
+
+func (r *appYAMLReport) problem(format string, args ...interface{}) {
+	r.problems = append(r.problems, fmt.Sprintf(format, args...))
+}
+
+// validateAppFile checks the app.yaml about to be deployed against the
+// built-in schema. All problems are reported at once.
+func validateAppFile(workspace string, vargs GAE) error {
+	appLoc := appFilePath(workspace, vargs)
+	blob, err := ioutil.ReadFile(appLoc)
+	if err != nil {
+		return fmt.Errorf("error reading app.yaml for validation: %s\n", err)
+	}
+
+	// appcfg.py still takes application and version from app.yaml
+	_, gcloud := gcloudActions[vargs.Action]
+	report, err := validateAppYAML(blob, gcloud)
+	if err != nil {
+		return fmt.Errorf("error: app.yaml is not valid YAML: %s\n", err)
+	}
+	for _, w := range report.warnings {
+		fmt.Printf("warning: app.yaml: %s\n", w)
+	}
+	if len(report.problems) > 0 {
+		return fmt.Errorf("error: app.yaml failed validation:\n  %s\n", strings.Join(report.problems, "\n  "))
+	}
+	return nil
+}
+
+// validateAppYAML reports the problems found in an app.yaml: wrong types,
+// keys that don't belong in the configured environment and, when deploying
+// with gcloud, keys gcloud rejects. Unknown keys are reported as warnings.
+func validateAppYAML(blob []byte, gcloud bool) (appYAMLReport, error) {
+	var r appYAMLReport
+
+	var app yaml.MapSlice
+	if err := yaml.Unmarshal(blob, &app); err != nil {
+		return r, err
+	}
+
+	env := envStandard
+	for _, item := range app {
+		// `vm: true` is how the flexible environment used to be enabled
+		if item.Key == "vm" && item.Value == true {
+			env = envFlex
+		}
+		if item.Key != "env" {
+			continue
+		}
+		switch item.Value {
+		case "flex", "flexible":
+			env = envFlex
+		case "standard":
+		default:
+			r.problem("env: unknown environment %v, must be standard or flex", item.Value)
+		}
+	}
+
+	hasRuntime := false
+	for _, item := range app {
+		key := fmt.Sprint(item.Key)
+		if key == "runtime" {
+			hasRuntime = true
+		}
+		if hint, ok := appYAMLRejected[key]; ok {
+			if gcloud {
+				r.problem("%s: not supported by gcloud, %s", key, hint)
+			}
+			continue
+		}
+		r.validateKey(key, item.Value, appYAMLSchema, env)
+	}
+
+	if !hasRuntime {
+		r.problem("runtime: missing required key")
+	}
+
+	return r, nil
+}
+
+func (r *appYAMLReport) validateKey(path string, value interface{}, schema map[string]appKey, env appEnv) {
+	name := path
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		name = path[i+1:]
+	}
+
+	spec, ok := schema[name]
+	if !ok {
+		r.warnings = append(r.warnings, fmt.Sprintf("%s: unknown key", path))
+		return
+	}
+
+	if spec.env == envStandard && env == envFlex {
+		r.problem("%s: not supported in the flexible environment", path)
+		return
+	}
+	if spec.env == envFlex && env == envStandard {
+		r.problem("%s: only supported in the flexible environment (env: flex)", path)
+		return
+	}
+
+	if !matchesKind(spec.kind, value) {
+		r.problem("%s: must be %s", path, spec.kind)
+		return
+	}
+
+	if path == "env_variables" {
+		r.validateEnvVariables(value.(yaml.MapSlice))
+		return
+	}
+
+	if spec.keys == nil {
+		return
+	}
+
+	switch value := value.(type) {
+	case yaml.MapSlice:
+		r.validateMap(path, value, spec.keys, env)
+	case []interface{}:
+		for i, v := range value {
+			m, ok := v.(yaml.MapSlice)
+			if !ok {
+				r.problem("%s[%d]: must be a mapping", path, i)
+				continue
+			}
+			r.validateMap(fmt.Sprintf("%s[%d]", path, i), m, spec.keys, env)
+		}
+	}
+}
+
+func (r *appYAMLReport) validateMap(path string, m yaml.MapSlice, keys map[string]appKey, env appEnv) {
+	for _, item := range m {
+		r.validateKey(path+"."+fmt.Sprint(item.Key), item.Value, keys, env)
+	}
+}
+
+func (r *appYAMLReport) validateEnvVariables(m yaml.MapSlice) {
+	for _, item := range m {
+		if !matchesKind(kindScalar, item.Value) {
+			r.problem("env_variables.%v: must be a scalar", item.Key)
+		}
+	}
+}
+
+func matchesKind(kind yamlKind, value interface{}) bool {
+	switch value.(type) {
+	case yaml.MapSlice:
+		return kind == kindMap
+	case []interface{}:
+		return kind == kindList || kind == kindListOrString
+	case string:
+		return kind == kindString || kind == kindScalar || kind == kindListOrString
+	case bool:
+		return kind == kindBool || kind == kindScalar
+	case int, int64, uint64, float64:
+		return kind == kindNumber || kind == kindScalar
+	case nil:
+		// an empty value is left for gcloud to complain about
+		return true
+	default:
+		return false
+	}
+}
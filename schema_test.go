@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateAppYAML(t *testing.T) {
+	tests := []struct {
+		name string
+
+		givenYAML string
+
+		wantProblems []string
+		wantWarnings []string
+		wantError    bool
+
+		// legacy is set for app.yaml deployed with appcfg.py
+		legacy bool
+	}{
+		{
+			name: "valid standard",
+			givenYAML: `runtime: go121
+service: api
+instance_class: F2
+env_variables:
+  HOST: example.com
+  PORT: 8080
+automatic_scaling:
+  max_instances: 10
+  standard_scheduler_settings:
+    target_cpu_utilization: 0.65
+    min_instances: 1
+handlers:
+- url: /.*
+  script: auto
+  secure: always
+`,
+		},
+		{
+			name: "valid flex",
+			givenYAML: `runtime: custom
+env: flex
+resources:
+  cpu: 1
+  memory_gb: 2
+automatic_scaling:
+  min_num_instances: 1
+  cpu_utilization:
+    target_utilization: 0.6
+liveness_check:
+  path: /healthz
+`,
+		},
+		{
+			name: "unknown keys and wrong types",
+			givenYAML: `runtime: go121
+servce: api
+threadsafe: "yes"
+handlers:
+- url: /
+  scirpt: auto
+- /static
+env_variables:
+  NESTED:
+    KEY: value
+`,
+
+			wantProblems: []string{
+				"threadsafe: must be a boolean",
+				"handlers[1]: must be a mapping",
+				"env_variables.NESTED: must be a scalar",
+			},
+			wantWarnings: []string{
+				"servce: unknown key",
+				"handlers[0].scirpt: unknown key",
+			},
+		},
+		{
+			name: "standard vs flex",
+			givenYAML: `runtime: python
+env: flex
+instance_class: F2
+automatic_scaling:
+  max_instances: 3
+`,
+
+			wantProblems: []string{
+				"instance_class: not supported in the flexible environment",
+				"automatic_scaling.max_instances: not supported in the flexible environment",
+			},
+		},
+		{
+			name: "flex keys in standard",
+			givenYAML: `runtime: go121
+resources:
+  cpu: 1
+`,
+
+			wantProblems: []string{
+				"resources: only supported in the flexible environment (env: flex)",
+			},
+		},
+		{
+			name: "missing runtime, bad env and rejected keys",
+			givenYAML: `env: flexy
+application: my-project
+version: v1
+`,
+
+			wantProblems: []string{
+				"env: unknown environment flexy, must be standard or flex",
+				"application: not supported by gcloud, set the project with the `project` setting instead",
+				"version: not supported by gcloud, set the version with the `version` setting instead",
+				"runtime: missing required key",
+			},
+		},
+		{
+			name: "appcfg.py takes application and version",
+			givenYAML: `runtime: python27
+application: my-project
+version: v1
+`,
+			legacy: true,
+		},
+		{
+			name:      "invalid yaml",
+			givenYAML: "runtime: [",
+
+			wantError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := validateAppYAML([]byte(test.givenYAML), !test.legacy)
+			if test.wantError {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.wantProblems, got.problems)
+				assert.Equal(t, test.wantWarnings, got.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	secretRefPrefix       = "sm://"
+	defaultSecretEndpoint = "https://secretmanager.googleapis.com"
+)
+
+// accessToken asks gcloud for an OAuth2 access token for the activated
+// service account.
+func accessToken(runner *Environ, vargs GAE) (string, error) {
+	out, err := runner.Output(vargs.GCloudCmd, "auth", "print-access-token")
+	if err != nil {
+		return "", fmt.Errorf("error creating access token: %s\n", err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// secretResolver fetches Secret Manager secret versions over REST.
+type secretResolver struct {
+	endpoint string
+	project  string
+	token    string
+	client   *http.Client
+
+	cache map[string]string
+}
+
+func newSecretResolver(endpoint, project, token string) *secretResolver {
+	if endpoint == "" {
+		endpoint = defaultSecretEndpoint
+	}
+	return &secretResolver{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		project:  project,
+		token:    token,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		cache:    map[string]string{},
+	}
+}
+
+// hasSecretRefs reports whether any TemplateVars or AEEnv values reference
+// Secret Manager, so we only fetch an access token when we need one.
+func hasSecretRefs(vargs GAE) bool {
+	found := false
+	walkStrings(vargs.TemplateVars, func(s string) string {
+		found = found || strings.HasPrefix(s, secretRefPrefix)
+		return s
+	})
+	for _, v := range vargs.AEEnv {
+		found = found || strings.HasPrefix(v, secretRefPrefix)
+	}
+	return found
+}
+
+// resolveSecretRefs replaces every sm:// value in TemplateVars and AEEnv
+// with the secret it references, returning the resolved secrets.
+func resolveSecretRefs(vargs *GAE, sr *secretResolver) ([]string, error) {
+	var resolved []string
+	var firstErr error
+	resolve := func(s string) string {
+		if !strings.HasPrefix(s, secretRefPrefix) || firstErr != nil {
+			return s
+		}
+		v, err := sr.resolve(s)
+		if err != nil {
+			firstErr = err
+			return s
+		}
+		resolved = append(resolved, v)
+		return v
+	}
+
+	for k, v := range vargs.TemplateVars {
+		vargs.TemplateVars[k] = walkStrings(v, resolve)
+	}
+	for k, v := range vargs.AEEnv {
+		vargs.AEEnv[k] = resolve(v)
+	}
+
+	return resolved, firstErr
+}
+
+// resolve fetches a secret reference in one of these forms:
+//
+//	sm://projects/PROJECT/secrets/NAME/versions/VERSION
+//	sm://NAME (the latest version, in the project being deployed to)
+func (sr *secretResolver) resolve(ref string) (string, error) {
+	if v, ok := sr.cache[ref]; ok {
+		return v, nil
+	}
+
+	name := strings.TrimPrefix(ref, secretRefPrefix)
+	if !strings.HasPrefix(name, "projects/") {
+		if name == "" || strings.Contains(name, "/") {
+			return "", fmt.Errorf("invalid secret reference %q: use sm://projects/PROJECT/secrets/NAME/versions/VERSION or sm://NAME", ref)
+		}
+		name = fmt.Sprintf("projects/%s/secrets/%s/versions/latest", sr.project, name)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, sr.endpoint+"/v1/"+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+sr.token)
+
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error accessing secret %q: %s", ref, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error accessing secret %q: %s", ref, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error accessing secret %q: %s: %s", ref, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", fmt.Errorf("error decoding secret %q: %s", ref, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(result.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("error decoding secret %q: %s", ref, err)
+	}
+
+	sr.cache[ref] = string(data)
+	return string(data), nil
+}
+
+// walkStrings calls fn on every string in v, including those nested in lists
+// and maps, replacing them with the result.
+func walkStrings(v interface{}, fn func(string) string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return fn(v)
+	case []interface{}:
+		for i, vv := range v {
+			v[i] = walkStrings(vv, fn)
+		}
+		return v
+	case map[string]interface{}:
+		for k, vv := range v {
+			v[k] = walkStrings(vv, fn)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSecretRefs(t *testing.T) {
+	secrets := map[string]string{
+		"/v1/projects/other/secrets/db-password/versions/3:access":       "hunter22",
+		"/v1/projects/my-project/secrets/api-key/versions/latest:access": "abc123",
+	}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		secret, ok := secrets[r.URL.Path]
+		if !ok {
+			http.Error(w, `{"error": {"status": "NOT_FOUND"}}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"name": %q, "payload": {"data": %q}}`,
+			r.URL.Path, base64.StdEncoding.EncodeToString([]byte(secret)))
+	}))
+	defer srv.Close()
+
+	vargs := GAE{
+		TemplateVars: map[string]interface{}{
+			"DB_PASSWORD": "sm://projects/other/secrets/db-password/versions/3",
+			"KEYS":        []interface{}{"sm://api-key", "plain"},
+			"HOST":        "example.com",
+		},
+		AEEnv: map[string]string{"API_KEY": "sm://api-key"},
+	}
+	assert.True(t, hasSecretRefs(vargs))
+
+	sr := newSecretResolver(srv.URL, "my-project", "token")
+	resolved, err := resolveSecretRefs(&vargs, sr)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hunter22", vargs.TemplateVars["DB_PASSWORD"])
+		assert.Equal(t, []interface{}{"abc123", "plain"}, vargs.TemplateVars["KEYS"])
+		assert.Equal(t, "example.com", vargs.TemplateVars["HOST"])
+		assert.Equal(t, "abc123", vargs.AEEnv["API_KEY"])
+		assert.ElementsMatch(t, []string{"hunter22", "abc123", "abc123"}, resolved)
+	}
+	// the same reference is only fetched once
+	assert.Equal(t, 2, requests)
+	assert.False(t, hasSecretRefs(vargs))
+
+	vargs = GAE{TemplateVars: map[string]interface{}{"MISSING": "sm://missing"}}
+	_, err = resolveSecretRefs(&vargs, sr)
+	assert.Error(t, err)
+
+	vargs = GAE{TemplateVars: map[string]interface{}{"BAD": "sm://a/b"}}
+	_, err = resolveSecretRefs(&vargs, sr)
+	assert.Error(t, err)
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SmokeTest is a single HTTP check run against a newly deployed version.
+type SmokeTest struct {
+	// Path is requested relative to the version URL (ex: /healthz).
+	Path string `json:"path"`
+	// Status is the expected HTTP status code. Defaults to 200.
+	Status int `json:"status"`
+	// Body is a substring the response body must contain.
+	Body string `json:"body"`
+	// BodyRegex is a regular expression the response body must match.
+	BodyRegex string `json:"body_regex"`
+	// MaxLatency is the longest the request may take (ex: 500ms).
+	MaxLatency string `json:"max_latency"`
+}
+
+// validateSmokeTests fills in defaults and makes sure all durations and
+// regular expressions parse before anything is deployed.
+func validateSmokeTests(vargs *GAE) error {
+	if len(vargs.SmokeTests) == 0 {
+		return nil
+	}
+
+	if vargs.SmokeRetries <= 0 {
+		vargs.SmokeRetries = 5
+	}
+
+	if vargs.SmokeRetryDelay == "" {
+		vargs.SmokeRetryDelay = "5s"
+	}
+	if _, err := time.ParseDuration(vargs.SmokeRetryDelay); err != nil {
+		return fmt.Errorf("invalid param smoke_retry_delay: %s", err)
+	}
+
+	for i, st := range vargs.SmokeTests {
+		if st.Status == 0 {
+			vargs.SmokeTests[i].Status = http.StatusOK
+		}
+		if st.BodyRegex != "" {
+			if _, err := regexp.Compile(st.BodyRegex); err != nil {
+				return fmt.Errorf("invalid body_regex for smoke test %q: %s", st.Path, err)
+			}
+		}
+		if st.MaxLatency != "" {
+			if _, err := time.ParseDuration(st.MaxLatency); err != nil {
+				return fmt.Errorf("invalid max_latency for smoke test %q: %s", st.Path, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// versionURL returns the URL that reaches a specific version of a service
+// without going through the traffic split.
+func versionURL(project, service, version string) string {
+	host := project + ".appspot.com"
+	if service != "" && service != "default" {
+		host = service + "-dot-" + host
+	}
+	if version != "" {
+		host = version + "-dot-" + host
+	}
+	return "https://" + host
+}
+
+// smokeTest runs all of the configured smoke tests against the newly deployed
+// version. If any fail and SmokeRollback is set, traffic is moved back to the
+// previously serving versions.
+func smokeTest(runner *Environ, workspace string, vargs GAE, previous []versionInfo, res *Result) error {
+	// prefer the URL gcloud reported: newer apps have a region ID in the host
+	// (ex: VERSION-dot-PROJECT.uc.r.appspot.com) that we can't guess
+	baseURL := vargs.SmokeBaseURL
+	if baseURL == "" {
+		baseURL = res.VersionURL
+	}
+	if baseURL == "" {
+		service, err := resolveService(workspace, vargs)
+		if err != nil {
+			return fmt.Errorf("error: unable to determine service for smoke tests: %s\n", err)
+		}
+		baseURL = versionURL(vargs.Project, service, vargs.Version)
+	}
+
+	err := runSmokeTests(baseURL, vargs)
+	if err == nil {
+		return nil
+	}
+
+	if vargs.SmokeRollback {
+		if rerr := rollbackTraffic(runner, workspace, vargs, previous); rerr != nil {
+			return fmt.Errorf("%s\nerror: rollback failed: %s\n", err, rerr)
+		}
+		res.RolledBack = true
+	}
+
+	return err
+}
+
+// runSmokeTests executes each smoke test against baseURL, retrying failures
+// with a delay between attempts.
+func runSmokeTests(baseURL string, vargs GAE) error {
+	delay, _ := time.ParseDuration(vargs.SmokeRetryDelay)
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	var failed []string
+	for _, st := range vargs.SmokeTests {
+		var err error
+		for attempt := 0; attempt <= vargs.SmokeRetries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(delay)
+			}
+			err = checkSmokeTest(baseURL, st)
+			if err == nil {
+				break
+			}
+			log.Printf("smoke test %s failed (attempt %d/%d): %s",
+				st.Path, attempt+1, vargs.SmokeRetries+1, err)
+		}
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %s", st.Path, err))
+			continue
+		}
+		log.Printf("smoke test %s passed", st.Path)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("error: %d smoke tests failed against %s:\n%s\n",
+			len(failed), baseURL, strings.Join(failed, "\n"))
+	}
+	return nil
+}
+
+func checkSmokeTest(baseURL string, st SmokeTest) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	var maxLatency time.Duration
+	if st.MaxLatency != "" {
+		maxLatency, _ = time.ParseDuration(st.MaxLatency)
+	}
+
+	path := st.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	start := time.Now()
+	resp, err := client.Get(baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	latency := time.Since(start)
+	if err != nil {
+		return fmt.Errorf("error reading response: %s", err)
+	}
+
+	want := st.Status
+	if want == 0 {
+		want = http.StatusOK
+	}
+	if resp.StatusCode != want {
+		return fmt.Errorf("expected status %d, got %d", want, resp.StatusCode)
+	}
+	if st.Body != "" && !strings.Contains(string(body), st.Body) {
+		return fmt.Errorf("response body does not contain %q", st.Body)
+	}
+	if st.BodyRegex != "" && !regexp.MustCompile(st.BodyRegex).Match(body) {
+		return fmt.Errorf("response body does not match %q", st.BodyRegex)
+	}
+	if maxLatency > 0 && latency > maxLatency {
+		return fmt.Errorf("response took %s, more than %s", latency, maxLatency)
+	}
+	return nil
+}
+
+// servingVersions looks up the versions of the deployed service that are
+// currently receiving traffic.
+func servingVersions(runner *Environ, workspace string, vargs GAE) ([]versionInfo, error) {
+	service, err := resolveService(workspace, vargs)
+	if err != nil {
+		return nil, err
+	}
+
+	versionJSON, err := runner.Output(vargs.GCloudCmd, "app", "versions", "list",
+		"--service", service, "--project", vargs.Project,
+		"--filter", "traffic_split>0", "--format", "json", "--quiet")
+	if err != nil {
+		return nil, err
+	}
+
+	var results []versionInfo
+	err = json.Unmarshal(versionJSON, &results)
+	return results, err
+}
+
+// rollbackTraffic restores the traffic split recorded before the deploy.
+func rollbackTraffic(runner *Environ, workspace string, vargs GAE, previous []versionInfo) error {
+	if len(previous) == 0 {
+		return fmt.Errorf("no previously serving versions to roll back to")
+	}
+
+	service, err := resolveService(workspace, vargs)
+	if err != nil {
+		return err
+	}
+
+	var splits []string
+	for _, v := range previous {
+		splits = append(splits, fmt.Sprintf("%s=%g", v.ID, v.TrafficSplit))
+	}
+
+	log.Printf("rolling back service %q to %s", service, strings.Join(splits, ","))
+
+	return runner.Run(vargs.GCloudCmd, "app", "services", "set-traffic", service,
+		"--splits", strings.Join(splits, ","), "--project", vargs.Project, "--quiet")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionURL(t *testing.T) {
+	assert.Equal(t, "https://v1-dot-api-dot-my-project.appspot.com", versionURL("my-project", "api", "v1"))
+	assert.Equal(t, "https://v1-dot-my-project.appspot.com", versionURL("my-project", "default", "v1"))
+	assert.Equal(t, "https://api-dot-my-project.appspot.com", versionURL("my-project", "api", ""))
+}
+
+func TestValidateSmokeTests(t *testing.T) {
+	vargs := GAE{SmokeTests: []SmokeTest{{Path: "/"}}}
+	assert.NoError(t, validateSmokeTests(&vargs))
+	assert.Equal(t, 5, vargs.SmokeRetries)
+	assert.Equal(t, "5s", vargs.SmokeRetryDelay)
+	assert.Equal(t, http.StatusOK, vargs.SmokeTests[0].Status)
+
+	vargs = GAE{SmokeTests: []SmokeTest{{Path: "/", BodyRegex: "("}}}
+	assert.Error(t, validateSmokeTests(&vargs))
+
+	vargs = GAE{SmokeTests: []SmokeTest{{Path: "/", MaxLatency: "fast"}}}
+	assert.Error(t, validateSmokeTests(&vargs))
+
+	vargs = GAE{SmokeTests: []SmokeTest{{Path: "/"}}, SmokeRetryDelay: "soon"}
+	assert.Error(t, validateSmokeTests(&vargs))
+}
+
+func TestRunSmokeTests(t *testing.T) {
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.Write([]byte(`{"status": "ok", "version": "v42"}`))
+		case "/flaky":
+			// fail the first request to exercise retries
+			hits++
+			if hits == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		case "/slow":
+			time.Sleep(50 * time.Millisecond)
+			w.Write([]byte("ok"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name string
+
+		givenTests []SmokeTest
+
+		wantError bool
+	}{
+		{
+			name: "happy path",
+			givenTests: []SmokeTest{
+				{Path: "/healthz", Body: `"ok"`, BodyRegex: `"version": "v\d+"`},
+				{Path: "missing", Status: http.StatusNotFound},
+			},
+		},
+		{
+			name:       "retries",
+			givenTests: []SmokeTest{{Path: "/flaky"}},
+		},
+		{
+			name:       "wrong status",
+			givenTests: []SmokeTest{{Path: "/missing"}},
+			wantError:  true,
+		},
+		{
+			name:       "wrong body",
+			givenTests: []SmokeTest{{Path: "/healthz", Body: "error"}},
+			wantError:  true,
+		},
+		{
+			name:       "body doesn't match",
+			givenTests: []SmokeTest{{Path: "/healthz", BodyRegex: `v\d{3}`}},
+			wantError:  true,
+		},
+		{
+			name:       "too slow",
+			givenTests: []SmokeTest{{Path: "/slow", MaxLatency: "10ms"}},
+			wantError:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vargs := GAE{
+				SmokeTests:      test.givenTests,
+				SmokeRetries:    1,
+				SmokeRetryDelay: "1ms",
+			}
+			assert.NoError(t, validateSmokeTests(&vargs))
+
+			err := runSmokeTests(srv.URL+"/", vargs)
+			if test.wantError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSmokeTestRollback(t *testing.T) {
+	healthy := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "drone-gae-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	vargs := GAE{
+		GCloudCmd:       writeFakeGcloud(t, dir, ""),
+		Project:         "prj",
+		Service:         "api",
+		Version:         "v2",
+		SmokeTests:      []SmokeTest{{Path: "/healthz"}},
+		SmokeRetries:    1,
+		SmokeRetryDelay: "1ms",
+		SmokeRollback:   true,
+	}
+	require.NoError(t, validateSmokeTests(&vargs))
+	runner := NewEnviron(dir, nil, &bytes.Buffer{}, &bytes.Buffer{})
+	previous := []versionInfo{{ID: "v1", TrafficSplit: 0.7}, {ID: "v0", TrafficSplit: 0.3}}
+
+	// the smoke tests hit the URL gcloud reported
+	res := &Result{VersionURL: srv.URL}
+	assert.NoError(t, smokeTest(runner, dir, vargs, previous, res))
+	assert.False(t, res.RolledBack)
+	assert.Empty(t, gcloudCalls(t, dir))
+
+	healthy = false
+	assert.Error(t, smokeTest(runner, dir, vargs, previous, res))
+	assert.True(t, res.RolledBack)
+	assert.Equal(t, []string{"app services set-traffic api --splits v1=0.7,v0=0.3 --project prj --quiet"},
+		gcloudCalls(t, dir))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// templateFuncs is the small library of helpers available to the yaml
+// templates, modeled after the most commonly used Sprig functions. vars are
+// the template variables, so helpers like `required` can look them up by name.
+func templateFuncs(vars map[string]interface{}) template.FuncMap {
+	return template.FuncMap{
+		// variables
+		"get":      func(name string) interface{} { return vars[name] },
+		"required": func(name string) (interface{}, error) { return required(vars, name) },
+		"default":  defaultValue,
+		"env":      os.Getenv,
+
+		// strings
+		"upper":   strings.ToUpper,
+		"lower":   strings.ToLower,
+		"trim":    strings.TrimSpace,
+		"replace": func(old, new string, s interface{}) string { return strings.Replace(toString(s), old, new, -1) },
+		"join":    join,
+		"quote":   func(v interface{}) string { return strconv.Quote(toString(v)) },
+		"squote":  func(v interface{}) string { return "'" + strings.Replace(toString(v), "'", "''", -1) + "'" },
+		"indent":  indent,
+		"nindent": func(n int, s string) string { return "\n" + indent(n, s) },
+
+		// encoding
+		"b64enc": func(v interface{}) string { return base64.StdEncoding.EncodeToString([]byte(toString(v))) },
+		"b64dec": b64dec,
+		"toJson": toJSON,
+		"toYaml": toYAML,
+	}
+}
+
+// required returns the named template variable, or an error naming it if it
+// is missing or empty.
+func required(vars map[string]interface{}, name string) (interface{}, error) {
+	v, ok := vars[name]
+	if !ok || isEmpty(v) {
+		return nil, fmt.Errorf("required template variable %q is missing or empty", name)
+	}
+	return v, nil
+}
+
+// defaultValue returns def if v is empty. Arguments are in this order so it
+// can be used in a pipeline: {{ get "REGION" | default "us-east1" }}
+func defaultValue(def, v interface{}) interface{} {
+	if isEmpty(v) {
+		return def
+	}
+	return v
+}
+
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	default:
+		return rv.IsZero()
+	}
+}
+
+func toString(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if s, ok := v.(string); ok {
+		return s
+	}
+	return fmt.Sprint(v)
+}
+
+func join(sep string, v interface{}) string {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return toString(v)
+	}
+	parts := make([]string, rv.Len())
+	for i := range parts {
+		parts[i] = toString(rv.Index(i).Interface())
+	}
+	return strings.Join(parts, sep)
+}
+
+func indent(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+func b64dec(s string) (string, error) {
+	blob, err := base64.StdEncoding.DecodeString(s)
+	return string(blob), err
+}
+
+func toJSON(v interface{}) (string, error) {
+	blob, err := json.Marshal(v)
+	return string(blob), err
+}
+
+func toYAML(v interface{}) (string, error) {
+	blob, err := yaml.Marshal(v)
+	return strings.TrimSuffix(string(blob), "\n"), err
+}
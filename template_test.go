@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequired(t *testing.T) {
+	_, err := required(map[string]interface{}{}, "API_KEY")
+	assert.EqualError(t, err, `required template variable "API_KEY" is missing or empty`)
+
+	v, err := required(map[string]interface{}{"API_KEY": "abc"}, "API_KEY")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", v)
+}
+
+func TestDefaultValue(t *testing.T) {
+	assert.Equal(t, "fallback", defaultValue("fallback", nil))
+	assert.Equal(t, "fallback", defaultValue("fallback", ""))
+	assert.Equal(t, "fallback", defaultValue("fallback", []string{}))
+	assert.Equal(t, "set", defaultValue("fallback", "set"))
+	assert.Equal(t, 3, defaultValue(1, 3))
+}
+
+func TestIndent(t *testing.T) {
+	assert.Equal(t, "  a\n  b", indent(2, "a\nb"))
+	assert.Equal(t, "a,b,3", join(",", []interface{}{"a", "b", 3}))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loadTemplateVars merges the template variables from all sources into
+// vargs.TemplateVars. From lowest to highest precedence:
+//
+//  1. vars_files, in the order given (later files win)
+//  2. vars_from_env_prefix
+//  3. vars
+func loadTemplateVars(workspace string, vargs *GAE) error {
+	if len(vargs.VarsFiles) == 0 && vargs.VarsEnvPrefix == "" {
+		return nil
+	}
+
+	vars := map[string]interface{}{}
+
+	for _, name := range vargs.VarsFiles {
+		if name == "" {
+			continue
+		}
+		fileVars, err := readVarsFile(filepath.Join(workspace, vargs.Dir, name))
+		if err != nil {
+			return fmt.Errorf("error reading vars file %q: %s\n", name, err)
+		}
+		for k, v := range fileVars {
+			vars[k] = v
+		}
+	}
+
+	for k, v := range envPrefixVars(os.Environ(), vargs.VarsEnvPrefix) {
+		vars[k] = v
+	}
+
+	for k, v := range vargs.TemplateVars {
+		vars[k] = v
+	}
+
+	vargs.TemplateVars = vars
+	return nil
+}
+
+// readVarsFile reads variables from a dotenv file (*.env, .env*) or a YAML
+// or JSON file.
+func readVarsFile(path string) (map[string]interface{}, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	base := filepath.Base(path)
+	if filepath.Ext(base) == ".env" || strings.HasPrefix(base, ".env") {
+		return parseDotenv(blob)
+	}
+
+	var raw map[interface{}]interface{}
+	if err := yaml.Unmarshal(blob, &raw); err != nil {
+		return nil, err
+	}
+	vars, _ := normalizeYAML(raw).(map[string]interface{})
+	return vars, nil
+}
+
+// normalizeYAML converts the map[interface{}]interface{} values produced by
+// the yaml package into map[string]interface{}, so they work with every
+// template function (toJson in particular).
+func normalizeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, vv := range v {
+			out[fmt.Sprint(k)] = normalizeYAML(vv)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, vv := range v {
+			out[i] = normalizeYAML(vv)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// parseDotenv parses KEY=VALUE lines. Blank lines, comments and a leading
+// `export` are ignored. Double quoted values may contain escapes like \n,
+// single quoted values are taken literally.
+func parseDotenv(blob []byte) (map[string]interface{}, error) {
+	vars := map[string]interface{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(blob))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", n, err)
+			}
+			value = unquoted
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		}
+
+		vars[key] = value
+	}
+	return vars, scanner.Err()
+}
+
+// envPrefixVars returns every environment variable starting with prefix as a
+// template variable, with the prefix removed (DEPLOY_HOST becomes HOST).
+func envPrefixVars(environ []string, prefix string) map[string]interface{} {
+	vars := map[string]interface{}{}
+	if prefix == "" {
+		return vars
+	}
+	for _, kv := range environ {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], prefix) {
+			continue
+		}
+		if key := kv[len(prefix):i]; key != "" {
+			vars[key] = kv[i+1:]
+		}
+	}
+	return vars
+}
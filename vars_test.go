@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadTemplateVars(t *testing.T) {
+	workspace, err := ioutil.TempDir("", "drone-gae")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(workspace)
+
+	files := map[string]string{
+		"common.yaml": "HOST: example.com\nREPLICAS: 2\nLABELS:\n  team: games\n",
+		"prd.json":    `{"HOST": "prd.example.com", "DEBUG": false}`,
+		"prd.env":     "# secrets\nexport TOKEN=\"abc\\n123\"\nNAME='my app'\nREGION=us-east1\n",
+	}
+	for name, contents := range files {
+		err = ioutil.WriteFile(filepath.Join(workspace, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("unable to write %s: %s", name, err)
+		}
+	}
+
+	os.Setenv("TESTDEPLOY_REGION", "europe-west1")
+	os.Setenv("TESTDEPLOY_NAME", "env app")
+	defer os.Unsetenv("TESTDEPLOY_REGION")
+	defer os.Unsetenv("TESTDEPLOY_NAME")
+
+	vargs := GAE{
+		VarsFiles:     []string{"common.yaml", "prd.json", "prd.env", ""},
+		VarsEnvPrefix: "TESTDEPLOY_",
+		TemplateVars:  map[string]interface{}{"NAME": "explicit app"},
+	}
+	assert.NoError(t, loadTemplateVars(workspace, &vargs))
+
+	assert.Equal(t, map[string]interface{}{
+		"HOST":     "prd.example.com",
+		"REPLICAS": 2,
+		"LABELS":   map[string]interface{}{"team": "games"},
+		"DEBUG":    false,
+		"TOKEN":    "abc\n123",
+		"NAME":     "explicit app",
+		"REGION":   "europe-west1",
+	}, vargs.TemplateVars)
+
+	vargs = GAE{VarsFiles: []string{"missing.yaml"}}
+	assert.Error(t, loadTemplateVars(workspace, &vargs))
+}
+
+func TestParseDotenv(t *testing.T) {
+	_, err := parseDotenv([]byte("KEY=value\nnot a pair\n"))
+	assert.EqualError(t, err, "line 2: expected KEY=VALUE")
+
+	got, err := parseDotenv([]byte("URL=https://example.com/?a=b\nEMPTY=\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"URL": "https://example.com/?a=b", "EMPTY": ""}, got)
+}
+
+func TestPrepareVargsTemplateVars(t *testing.T) {
+	workspace, err := ioutil.TempDir("", "drone-gae")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(workspace)
+
+	err = ioutil.WriteFile(filepath.Join(workspace, "prd.env"), []byte("TRACK=beta\n"), 0644)
+	if err != nil {
+		t.Fatalf("unable to write prd.env: %s", err)
+	}
+
+	os.Setenv("TESTPREPARE_BUILD", "42")
+	defer os.Unsetenv("TESTPREPARE_BUILD")
+
+	// version_template sees vars from vars_files and vars_from_env_prefix
+	vargs := GAE{
+		Token:           "mytoken",
+		Project:         "myproject",
+		Action:          "deploy",
+		VarsFiles:       []string{"prd.env"},
+		VarsEnvPrefix:   "TESTPREPARE_",
+		VersionTemplate: `{{ required "TRACK" }}-{{ get "BUILD" }}`,
+	}
+	assert.NoError(t, prepareVargs(workspace, &vargs))
+	assert.Equal(t, "beta-42", vargs.Version)
+
+	vargs = GAE{
+		Token:           "mytoken",
+		Project:         "myproject",
+		Action:          "deploy",
+		VersionTemplate: `{{ required "TRACK" }}`,
+	}
+	assert.Error(t, prepareVargs(workspace, &vargs))
+}
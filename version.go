@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const maxVersionLen = 63
+
+var reInvalidVersion = regexp.MustCompile(`[^a-z\d-]`)
+
+// renderVersion executes VersionTemplate against the Drone build metadata,
+// ex: {{ .Branch }}-{{ .ShortSHA }}-{{ .BuildNumber }}
+func renderVersion(vargs GAE) (string, error) {
+	tmpl, err := template.New("version_template").
+		Funcs(templateFuncs(vargs.TemplateVars)).
+		Option("missingkey=error").
+		Parse(vargs.VersionTemplate)
+	if err != nil {
+		return "", fmt.Errorf("error parsing version_template: %s", err)
+	}
+
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, droneMetadata(os.Getenv))
+	if err != nil {
+		return "", fmt.Errorf("error executing version_template: %s", err)
+	}
+	return out.String(), nil
+}
+
+// sanitizeVersion turns raw into a valid App Engine version name: lowercase
+// letters, digits and hyphens, starting and ending with a letter or digit, at
+// most 63 characters, not starting with "ah-" and not "default" or "latest".
+// Names that are too long are truncated and get a short hash of raw appended,
+// so long names that only differ at the end don't collide.
+func sanitizeVersion(raw string) (string, error) {
+	v := reInvalidVersion.ReplaceAllString(strings.ToLower(raw), "-")
+	v = strings.Trim(v, "-")
+	if v == "" {
+		return "", fmt.Errorf("version %q has no valid characters: use lowercase letters, digits and hyphens", raw)
+	}
+
+	// reserved names get a prefix rather than an error
+	if strings.HasPrefix(v, "ah-") || v == "default" || v == "latest" {
+		v = "v-" + v
+	}
+
+	if len(v) > maxVersionLen {
+		sum := sha1.Sum([]byte(raw))
+		suffix := "-" + hex.EncodeToString(sum[:])[:6]
+		v = strings.TrimRight(v[:maxVersionLen-len(suffix)], "-") + suffix
+	}
+
+	return v, nil
+}
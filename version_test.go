@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSanitizeVersion(t *testing.T) {
+	tests := []struct {
+		given string
+
+		want      string
+		wantError bool
+	}{
+		{given: "v1", want: "v1"},
+		{given: "Feature/PRJ-123", want: "feature-prj-123"},
+		{given: "-leading-and-trailing-", want: "leading-and-trailing"},
+		{given: "feature/", want: "feature"},
+		{given: "ah-builtin", want: "v-ah-builtin"},
+		{given: "default", want: "v-default"},
+		{given: "Latest", want: "v-latest"},
+		{given: "20240102t030405", want: "20240102t030405"},
+		{given: "", wantError: true},
+		{given: "///", wantError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.given, func(t *testing.T) {
+			got, err := sanitizeVersion(test.given)
+			if test.wantError {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, test.want, got)
+			}
+		})
+	}
+}
+
+func TestSanitizeVersionTruncation(t *testing.T) {
+	long := strings.Repeat("a", 70)
+
+	a, err := sanitizeVersion(long + "-one")
+	assert.NoError(t, err)
+	b, err := sanitizeVersion(long + "-two")
+	assert.NoError(t, err)
+
+	assert.Len(t, a, maxVersionLen)
+	assert.Len(t, b, maxVersionLen)
+	assert.NotEqual(t, a, b)
+	assert.True(t, strings.HasPrefix(a, strings.Repeat("a", 56)+"-"))
+}